@@ -6,7 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"net/url"
@@ -15,15 +19,23 @@ import (
 	"github.com/go-zoox/core-utils/strings"
 	"github.com/go-zoox/logger"
 	"github.com/go-zoox/safe"
-	"github.com/go-zoox/websocket"
 )
 
 // Client is the interface of caas client
 type Client interface {
 	Connect() error
-	Exec(command *entities.Command) error
+	Exec(command *entities.Command, opts ...func(opt *ExecOption)) error
+	// Detach runs the command in background of server, returns the job id immediately
+	Detach(command *entities.Command) (id string, err error)
+	// Attach replays the output of job from offset, and follows the live output until exit
+	Attach(id string, offset int64, opts ...func(opt *ExecOption)) error
 	Close() error
 	//
+	// Resize resizes the terminals of all running tty commands
+	Resize(rows, cols int) error
+	// Signal sends the signal to all running commands
+	Signal(sig os.Signal) error
+	//
 	Output(command *entities.Command) (response string, err error)
 	//
 	TerminalURL(path ...string) string
@@ -32,14 +44,26 @@ type Client interface {
 type ExitError struct {
 	ExitCode int
 	Message  string
+	//
+	Signal   string
+	Reason   string
+	Duration time.Duration
 }
 
 func (e ExitError) Error() string {
+	reason := ""
+	if e.Reason != "" && e.Reason != entities.ExitReasonExited {
+		reason = fmt.Sprintf(", reason: %s", e.Reason)
+	}
+	if e.Signal != "" {
+		reason += fmt.Sprintf(", signal: %s", e.Signal)
+	}
+
 	if e.Message != "" {
-		return fmt.Sprintf("exit code: %d, message: %s", e.ExitCode, e.Message)
+		return fmt.Sprintf("exit code: %d%s, message: %s", e.ExitCode, reason, e.Message)
 	}
 
-	return fmt.Sprintf("exit code: %d", e.ExitCode)
+	return fmt.Sprintf("exit code: %d%s", e.ExitCode, reason)
 }
 
 // Config is the configuration of caas client
@@ -47,17 +71,47 @@ type Config struct {
 	Server       string `config:"server"`
 	ClientID     string `config:"client_id"`
 	ClientSecret string `config:"client_secret"`
+	// Token is the jwt, which is used instead of client id and secret
+	Token string `config:"token"`
+	// TLS, TLSCA is the ca to verify server, TLSCert and TLSKey is the client certificate for mutual tls
+	TLSCA                 string `config:"tls_ca"`
+	TLSCert               string `config:"tls_cert"`
+	TLSKey                string `config:"tls_key"`
+	TLSInsecureSkipVerify bool   `config:"tls_insecure_skip_verify"`
 	//
+	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
 	//
+	// ExecTimeout is the timeout of exec, which is sent to the server as the command timeout if set,
+	// the default DefaultExecTimeout only stops waiting in client.
 	ExecTimeout time.Duration `config:"exec_timeout"`
+	// IsSignalForwardingDisabled disables forwarding SIGINT (ctrl-c), SIGTERM and SIGHUP to the remote command when exec,
+	// which is enabled by default, so that the remote command is not left running when the client is interrupted.
+	IsSignalForwardingDisabled bool `config:"is_signal_forwarding_disabled"`
+}
+
+// DefaultExecTimeout is the timeout of waiting for exec in client, if ExecTimeout is not set
+const DefaultExecTimeout = 7 * 24 * time.Hour
+
+// ExecOption is the option of exec, which overrides the config for this command
+type ExecOption struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// OnQueued is called when the command is waiting in server queue, position starts from 1
+	OnQueued func(position int)
 }
 
 type client struct {
 	cfg *Config
 	//
-	exitCode chan int
+	streamsMu sync.Mutex
+	streams   map[string]*stream
+	//
+	doneCh   chan struct{}
+	doneOnce sync.Once
+	doneExit *entities.Exit
 	//
 	stdout io.Writer
 	stderr io.Writer
@@ -81,15 +135,12 @@ func New(cfg *Config) Client {
 		stderr = os.Stderr
 	}
 
-	if cfg.ExecTimeout == 0 {
-		cfg.ExecTimeout = 7 * 24 * time.Hour
-	}
-
 	return &client{
-		cfg:      cfg,
-		exitCode: make(chan int),
-		stdout:   stdout,
-		stderr:   stderr,
+		cfg:     cfg,
+		streams: map[string]*stream{},
+		doneCh:  make(chan struct{}),
+		stdout:  stdout,
+		stderr:  stderr,
 		//
 		messageCh: make(chan []byte),
 		authCh:    make(chan struct{}),
@@ -104,43 +155,71 @@ func (c *client) Connect() (err error) {
 	}
 	logger.Debugf("connecting to %s", u.String())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	wc, err := websocket.NewClient(func(opt *websocket.ClientOption) {
-		opt.Context = ctx
-		opt.Addr = u.String()
-	})
+	tlsCfg, err := newTLSConfig(c.cfg)
 	if err != nil {
-		cancel()
 		return err
 	}
 
-	wc.OnClose(func(conn websocket.Conn, code int, message string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	onClose := func(code int, message string) {
 		c.stderr.Write([]byte(fmt.Sprintf("connection closed from server: %s\n", message)))
-		c.exitCode <- 1
-		return nil
-	})
+		c.fail(&entities.Exit{Code: 1, Reason: entities.ExitReasonDisconnected, Message: message})
+	}
 
-	wc.OnTextMessage(func(conn websocket.Conn, message []byte) error {
-		switch message[0] {
-		case entities.MessageCommandStdout:
-			c.stdout.Write(message[1:])
-		case entities.MessageCommandStderr:
-			c.stderr.Write(message[1:])
-		case entities.MessageCommandExitCode:
-			c.exitCode <- int(message[1])
+	onTextMessage := func(message []byte) {
+		flag, id, payload, err := entities.DecodeFrame(message)
+		if err != nil {
+			logger.Errorf("failed to decode message: %s", err)
+			return
+		}
+
+		switch flag {
 		case entities.MessageAuthResponseFailure:
-			c.stderr.Write(message[1:])
-			c.exitCode <- 1
+			c.stderr.Write(payload)
+			c.fail(&entities.Exit{Code: 1, Reason: entities.ExitReasonUnauthenticated, Message: strings.TrimSpace(string(payload))})
+			return
 		case entities.MessageAuthResponseSuccess:
 			c.authCh <- struct{}{}
-		default:
-			logger.Errorf("unknown message type: %d", message[0])
+			return
+		case entities.MessageServerShutdown:
+			logger.Warnf("server is shutting down: %s", payload)
+			return
 		}
 
-		return nil
-	})
+		s := c.getStream(id)
+		if s == nil {
+			logger.Debugf("stream(%s) not found, ignore message: %d", id, flag)
+			return
+		}
+
+		switch flag {
+		case entities.MessageCommandStdout:
+			s.stdout.Write(payload)
+		case entities.MessageCommandStderr:
+			s.stderr.Write(payload)
+		case entities.MessageCommandExitCode:
+			s.exit <- decodeExit(payload)
+		case entities.MessageCommandDetached:
+			s.detached <- string(payload)
+		case entities.MessageCommandQueued:
+			queue := &entities.Queue{}
+			if err := json.Unmarshal(payload, queue); err != nil {
+				logger.Errorf("failed to decode queue message: %s", err)
+				return
+			}
+
+			if s.onQueued != nil {
+				s.onQueued(queue.Position)
+			} else {
+				logger.Infof("command is waiting in queue, position: %d", queue.Position)
+			}
+		default:
+			logger.Errorf("unknown message type: %d", flag)
+		}
+	}
 
-	wc.OnConnect(func(conn websocket.Conn) error {
+	onConnect := func(conn *wsConn) error {
 		cancel()
 
 		// close
@@ -155,12 +234,13 @@ func (c *client) Connect() (err error) {
 			authRequest := &entities.AuthRequest{
 				ClientID:     c.cfg.ClientID,
 				ClientSecret: c.cfg.ClientSecret,
+				Token:        c.cfg.Token,
 			}
 			message, err := json.Marshal(authRequest)
 			if err != nil {
 				logger.Errorf("failed to marshal auth request: %s", err)
 			}
-			err = conn.WriteTextMessage(append([]byte{entities.MessageAuthRequest}, message...))
+			err = conn.WriteTextMessage(entities.EncodeFrame(entities.MessageAuthRequest, "", message))
 			if err != nil {
 				logger.Errorf("failed to send auth request: %s", err)
 			}
@@ -174,7 +254,7 @@ func (c *client) Connect() (err error) {
 				time.Sleep(3 * time.Second)
 
 				logger.Debugf("ping")
-				if err := conn.WriteTextMessage([]byte{entities.MessagePing}); err != nil {
+				if err := conn.WriteTextMessage(entities.EncodeFrame(entities.MessagePing, "", nil)); err != nil {
 					logger.Debugf("failed to send ping: %s", err)
 					return
 				}
@@ -195,50 +275,296 @@ func (c *client) Connect() (err error) {
 		}()
 
 		return nil
-	})
+	}
 
-	if err := wc.Connect(); err != nil {
+	if err := dial(ctx, u.String(), tlsCfg, onConnect, onTextMessage, onClose); err != nil {
+		cancel()
 		return err
 	}
 
-	return
+	return nil
 }
 
-func (c *client) Exec(command *entities.Command) error {
-	go func() {
-		time.AfterFunc(c.cfg.ExecTimeout, func() {
-			c.stderr.Write([]byte("command exec timeout\n"))
-			c.exitCode <- 1
-		})
-	}()
+func (c *client) Exec(command *entities.Command, opts ...func(opt *ExecOption)) error {
+	_, err := c.exec(command, opts...)
+	return err
+}
 
-	message, err := json.Marshal(command)
+func (c *client) Detach(command *entities.Command) (id string, err error) {
+	// the command of caller is not changed
+	commandN := *command
+	commandN.Detached = true
+	commandN.Stdin = false
+	commandN.TTY = false
+
+	return c.exec(&commandN, func(opt *ExecOption) {
+		opt.Stdin = nil
+	})
+}
+
+func (c *client) Attach(id string, offset int64, opts ...func(opt *ExecOption)) error {
+	opt := &ExecOption{
+		Stdout: c.stdout,
+		Stderr: c.stderr,
+	}
+	for _, o := range opts {
+		o(opt)
+	}
+
+	message, err := json.Marshal(&entities.Attach{
+		ID:     id,
+		Offset: offset,
+	})
 	if err != nil {
 		return &ExitError{
+			ExitCode: 1,
+			Message:  fmt.Sprintf("failed to marshal attach request: %s", err),
+		}
+	}
+
+	s := c.newStream(false, opt.Stdout, opt.Stderr)
+	defer c.removeStream(s.id)
+
+	if !c.send(entities.EncodeFrame(entities.MessageCommandAttach, s.id, message)) {
+		return &ExitError{
+			ExitCode: 1,
+			Reason:   entities.ExitReasonDisconnected,
+			Message:  "client is closed",
+		}
+	}
+
+	_, err = c.wait(s, opt)
+	return err
+}
+
+func (c *client) exec(command *entities.Command, opts ...func(opt *ExecOption)) (id string, err error) {
+	opt := &ExecOption{
+		Stdin:  c.cfg.Stdin,
+		Stdout: c.stdout,
+		Stderr: c.stderr,
+	}
+	for _, o := range opts {
+		o(opt)
+	}
+
+	// the command of caller is not changed
+	commandN := *command
+	command = &commandN
+
+	if opt.Stdin != nil {
+		command.Stdin = true
+	}
+
+	// the server stops the command when exec timeout, which is capped by the server timeout,
+	// the timeout is only sent if set, so that the server timeout is used by default
+	if command.Timeout == 0 && c.cfg.ExecTimeout > 0 {
+		command.Timeout = int64(math.Ceil(c.cfg.ExecTimeout.Seconds()))
+	}
+
+	message, err := json.Marshal(command)
+	if err != nil {
+		return "", &ExitError{
 			ExitCode: 1,
 			Message:  fmt.Sprintf("failed to marshal command request: %s", err),
 		}
 	}
 
-	c.messageCh <- append([]byte{entities.MessageCommand}, message...)
+	s := c.newStream(command.TTY, opt.Stdout, opt.Stderr)
+	s.onQueued = opt.OnQueued
+	defer c.removeStream(s.id)
 
-	exitCode := <-c.exitCode
+	if !c.send(entities.EncodeFrame(entities.MessageCommand, s.id, message)) {
+		return "", &ExitError{
+			ExitCode: 1,
+			Reason:   entities.ExitReasonDisconnected,
+			Message:  "client is closed",
+		}
+	}
 
-	if exitCode == 0 {
-		return nil
+	if !c.cfg.IsSignalForwardingDisabled {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		defer signal.Stop(signals)
+
+		done := make(chan struct{})
+		defer close(done)
+
+		go func() {
+			for {
+				select {
+				case sig := <-signals:
+					if err := c.signal(s.id, sig); err != nil {
+						logger.Errorf("failed to forward signal(%s): %s", sig, err)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	if command.Stdin && opt.Stdin != nil {
+		flag := byte(entities.MessageCommandStdin)
+		if command.TTY {
+			flag = entities.MessageTerminalInput
+		}
+
+		go c.sendStdin(s.id, flag, opt.Stdin)
+	}
+
+	return c.wait(s, opt)
+}
+
+// wait waits for the exit or job id (detached) of the stream.
+func (c *client) wait(s *stream, opt *ExecOption) (id string, err error) {
+	timeout := c.cfg.ExecTimeout
+	if timeout <= 0 {
+		timeout = DefaultExecTimeout
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var exit *entities.Exit
+	select {
+	case id = <-s.detached:
+		return id, nil
+	case exit = <-s.exit:
+	case <-c.doneCh:
+		exit = c.doneExit
+	case <-timer.C:
+		// make sure the remote command does not keep running
+		c.signal(s.id, syscall.SIGKILL)
+
+		opt.Stderr.Write([]byte("command exec timeout\n"))
+		exit = &entities.Exit{Code: 1, Reason: entities.ExitReasonTimeout, Message: "command exec timeout"}
+	}
+
+	if exit.Code == 0 && (exit.Reason == "" || exit.Reason == entities.ExitReasonExited) {
+		return "", nil
+	}
+
+	return "", &ExitError{
+		ExitCode: exit.Code,
+		Message:  exit.Message,
+		Signal:   exit.Signal,
+		Reason:   exit.Reason,
+		Duration: time.Duration(exit.Duration) * time.Millisecond,
+	}
+}
+
+// fail fails all the running commands when the connection is broken.
+func (c *client) fail(exit *entities.Exit) {
+	c.doneOnce.Do(func() {
+		c.doneExit = exit
+		close(c.doneCh)
+	})
+}
+
+// decodeExit decodes the exit payload.
+func decodeExit(payload []byte) *entities.Exit {
+	exit := &entities.Exit{}
+	if err := json.Unmarshal(payload, exit); err != nil {
+		return &entities.Exit{Code: 1, Reason: entities.ExitReasonInternalError, Message: fmt.Sprintf("invalid exit message: %s", err)}
+	}
+
+	return exit
+}
+
+func (c *client) sendStdin(id string, flag byte, stdin io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := stdin.Read(buf)
+		if n > 0 {
+			if !c.send(entities.EncodeFrame(flag, id, buf[:n])) {
+				return
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				logger.Errorf("failed to read stdin: %s", err)
+			}
+
+			c.send(entities.EncodeFrame(entities.MessageCommandStdinEOF, id, nil))
+			return
+		}
 	}
+}
 
-	return &ExitError{
-		ExitCode: exitCode,
+// send sends the message to server, returns false if the client is closed.
+func (c *client) send(message []byte) bool {
+	select {
+	case c.messageCh <- message:
+		return true
+	case <-c.closeCh:
+		return false
+	case <-c.doneCh:
+		return false
 	}
 }
 
+func (c *client) Resize(rows, cols int) error {
+	for _, s := range c.getStreams() {
+		if !s.tty {
+			continue
+		}
+
+		if err := c.resize(s.id, rows, cols); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *client) resize(id string, rows, cols int) error {
+	message, err := json.Marshal(&entities.TerminalSize{
+		Rows: rows,
+		Cols: cols,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal terminal size: %s", err)
+	}
+
+	if !c.send(entities.EncodeFrame(entities.MessageTerminalResize, id, message)) {
+		return fmt.Errorf("client is closed")
+	}
+
+	return nil
+}
+
+func (c *client) Signal(sig os.Signal) error {
+	for _, s := range c.getStreams() {
+		if err := c.signal(s.id, sig); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *client) signal(id string, sig os.Signal) error {
+	name := entities.SignalName(sig)
+	if name == "" {
+		return fmt.Errorf("unsupported signal: %s", sig)
+	}
+
+	if !c.send(entities.EncodeFrame(entities.MessageCommandSignal, id, []byte(name))) {
+		return fmt.Errorf("client is closed")
+	}
+
+	return nil
+}
+
 func (c *client) Output(command *entities.Command) (response string, err error) {
 	responseBuf := NewBufWriter()
 
-	c.stdout = responseBuf
-	c.stderr = responseBuf
-	if err = c.Exec(command); err != nil {
+	err = c.Exec(command, func(opt *ExecOption) {
+		opt.Stdout = responseBuf
+		opt.Stderr = responseBuf
+	})
+	if err != nil {
 		return strings.TrimSpace(responseBuf.String()), nil
 	}
 
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConn is the websocket connection of client
+type wsConn struct {
+	conn *websocket.Conn
+	// writeMu serializes the writes, which is required by websocket.Conn
+	writeMu sync.Mutex
+}
+
+func (c *wsConn) WriteTextMessage(msg []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// dial dials the server, with the tls config if not nil, the messages are read in background until closed.
+// onConnect is called after the read loop is started.
+func dial(
+	ctx context.Context,
+	addr string,
+	tlsCfg *tls.Config,
+	onConnect func(conn *wsConn) error,
+	onTextMessage func(message []byte),
+	onClose func(code int, message string),
+) error {
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		TLSClientConfig:  tlsCfg,
+	}
+
+	raw, _, err := dialer.DialContext(ctx, addr, nil)
+	if err != nil {
+		return err
+	}
+
+	conn := &wsConn{conn: raw}
+	go func() {
+		for {
+			typ, message, err := raw.ReadMessage()
+			if err != nil {
+				code, text := websocket.CloseAbnormalClosure, err.Error()
+				if errx, ok := err.(*websocket.CloseError); ok {
+					code, text = errx.Code, errx.Text
+				}
+
+				onClose(code, text)
+				return
+			}
+
+			if typ == websocket.TextMessage {
+				onTextMessage(message)
+			}
+		}
+	}()
+
+	return onConnect(conn)
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// stream is a command running in the connection, which has its own output and exit.
+type stream struct {
+	id     string
+	tty    bool
+	stdout io.Writer
+	stderr io.Writer
+	exit   chan *entities.Exit
+	// detached receives the job id of detached command
+	detached chan string
+	// onQueued is called with the position when waiting in server queue
+	onQueued func(position int)
+}
+
+var streamSeq uint64
+
+func (c *client) newStream(tty bool, stdout, stderr io.Writer) *stream {
+	s := &stream{
+		id:     fmt.Sprintf("%d", atomic.AddUint64(&streamSeq, 1)),
+		tty:    tty,
+		stdout: stdout,
+		stderr: stderr,
+		exit:   make(chan *entities.Exit, 1),
+		//
+		detached: make(chan string, 1),
+	}
+
+	c.streamsMu.Lock()
+	c.streams[s.id] = s
+	c.streamsMu.Unlock()
+
+	return s
+}
+
+func (c *client) getStream(id string) *stream {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+
+	return c.streams[id]
+}
+
+func (c *client) removeStream(id string) {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+
+	delete(c.streams, id)
+}
+
+func (c *client) getStreams() []*stream {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+
+	streams := make([]*stream, 0, len(c.streams))
+	for _, s := range c.streams {
+		streams = append(streams, s)
+	}
+
+	return streams
+}
@@ -0,0 +1,8 @@
+package entities
+
+// Attach is the request for attach to a running or finished job
+type Attach struct {
+	ID string `json:"id"`
+	// Offset is the byte offset of log to replay from
+	Offset int64 `json:"offset"`
+}
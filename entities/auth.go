@@ -4,4 +4,6 @@ package entities
 type AuthRequest struct {
 	ClientID     string `json:"client_id"`
 	ClientSecret string `json:"client_secret"`
+	// Token is the jwt, which is used instead of client id and secret
+	Token string `json:"token,omitempty"`
 }
@@ -2,10 +2,26 @@ package entities
 
 // Command is the request for command
 type Command struct {
-	ID          string            `json:"id"`
-	Script      string            `json:"script"`
+	// ID makes the submission idempotent, the job with the same id is attached if running, or replies its result if finished
+	ID     string `json:"id"`
+	Script string `json:"script"`
+	// Template is the name of command template in server, the script is rendered by the args
+	Template    string            `json:"template,omitempty"`
+	Args        map[string]any    `json:"args,omitempty"`
 	Environment map[string]string `json:"environment"`
 	WorkDirBase string            `json:"workdirbase"`
+	// Stdin means the client streams stdin by MessageCommandStdin until MessageCommandStdinEOF
+	Stdin bool `json:"stdin"`
+	// TTY means run the command in a pty, input by MessageTerminalInput and resize by MessageTerminalResize
+	TTY  bool `json:"tty"`
+	Rows int  `json:"rows"`
+	Cols int  `json:"cols"`
+	// Detached means run in background, which survives client disconnect and replies job id by MessageCommandDetached
+	Detached bool `json:"detached"`
+	// Force runs the job again as a new attempt even if the job with the same id is finished
+	Force bool `json:"force"`
+	// Timeout is the timeout in seconds, which is capped by the timeout of server
+	Timeout int64 `json:"timeout"`
 	//
 	User string `json:"user"`
 	//
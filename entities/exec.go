@@ -0,0 +1,20 @@
+package entities
+
+// ExecResult is the result of the synchronous http exec
+type ExecResult struct {
+	ID       string `json:"id"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exit_code"`
+	Exit     *Exit  `json:"exit,omitempty"`
+	// Truncated is true if the output is over the max size, the rest is dropped
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ExecEvent is the line of the streaming http exec, one of the fields is set
+type ExecEvent struct {
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+	Exit   *Exit  `json:"exit,omitempty"`
+	Queued *Queue `json:"queued,omitempty"`
+}
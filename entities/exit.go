@@ -0,0 +1,79 @@
+package entities
+
+import (
+	"strings"
+	"syscall"
+)
+
+// Exit is the payload of MessageCommandExitCode
+type Exit struct {
+	Code int `json:"code"`
+	// Signal is the name of signal which terminated the command, like SIGKILL
+	Signal string `json:"signal,omitempty"`
+	Reason string `json:"reason"`
+	// Message is the error message, empty if succeed
+	Message string `json:"message,omitempty"`
+	// Duration is the running duration in milliseconds
+	Duration int64 `json:"duration"`
+}
+
+// ExitReasonExited means the command exited by itself
+const ExitReasonExited = "exited"
+
+// ExitReasonSignaled means the command was terminated by a signal
+const ExitReasonSignaled = "signaled"
+
+// ExitReasonTimeout means the command was killed by timeout
+const ExitReasonTimeout = "timeout"
+
+// ExitReasonKilled means the command was cancelled
+const ExitReasonKilled = "killed"
+
+// ExitReasonQueueTimeout means the command waited in queue too long
+const ExitReasonQueueTimeout = "queue_timeout"
+
+// ExitReasonQuotaExceeded means the client exceeded its quota
+const ExitReasonQuotaExceeded = "quota_exceeded"
+
+// ExitReasonInterrupted means the command was interrupted by server shutdown or crash
+const ExitReasonInterrupted = "interrupted"
+
+// ExitReasonUnavailable means the server is not accepting new commands
+const ExitReasonUnavailable = "unavailable"
+
+// ExitReasonSpawnFailed means the command failed to start
+const ExitReasonSpawnFailed = "spawn_failed"
+
+// ExitReasonInvalidRequest means the command request is invalid
+const ExitReasonInvalidRequest = "invalid_request"
+
+// ExitReasonUnauthenticated means the client is not authenticated
+const ExitReasonUnauthenticated = "unauthenticated"
+
+// ExitReasonPermissionDenied means the command is denied by the policy of client
+const ExitReasonPermissionDenied = "permission_denied"
+
+// ExitReasonDisconnected means the connection is closed before exit
+const ExitReasonDisconnected = "disconnected"
+
+// ExitReasonInternalError means the server failed to handle the command
+const ExitReasonInternalError = "internal_error"
+
+// ParseSignal returns the signal name from the error message of a signaled process, like `signal: killed` is SIGKILL,
+// which is used when the wait status is not kept by the engine.
+func ParseSignal(message string) string {
+	if !strings.HasPrefix(message, "signal: ") {
+		return ""
+	}
+
+	description := strings.TrimSuffix(strings.TrimPrefix(message, "signal: "), " (core dumped)")
+	for _, signals := range []map[string]syscall.Signal{Signals, exitSignals} {
+		for name, sig := range signals {
+			if sig.String() == description {
+				return name
+			}
+		}
+	}
+
+	return description
+}
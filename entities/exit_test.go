@@ -0,0 +1,37 @@
+package entities
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	testcases := map[string]string{
+		"signal: killed":                           "SIGKILL",
+		"signal: terminated":                       "SIGTERM",
+		"signal: segmentation fault (core dumped)": "SIGSEGV",
+		"signal: broken pipe":                      "SIGPIPE",
+		"signal: unknown":                          "unknown",
+		"exit status 1":                            "",
+	}
+
+	for message, expected := range testcases {
+		if name := ParseSignal(message); name != expected {
+			t.Fatalf("expected signal %q of %q, got %q", expected, message, name)
+		}
+	}
+}
+
+func TestExitSignalName(t *testing.T) {
+	testcases := map[syscall.Signal]string{
+		syscall.SIGKILL:   "SIGKILL",
+		syscall.SIGSEGV:   "SIGSEGV",
+		syscall.Signal(0): syscall.Signal(0).String(),
+	}
+
+	for sig, expected := range testcases {
+		if name := ExitSignalName(sig); name != expected {
+			t.Fatalf("expected signal name %q, got %q", expected, name)
+		}
+	}
+}
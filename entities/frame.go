@@ -0,0 +1,35 @@
+package entities
+
+import "fmt"
+
+// EncodeFrame encodes the message of the stream, which is used to multiplex commands in one connection.
+//
+// Format: <flag: 1 byte><stream length: 1 byte><stream><payload>
+//
+// Messages of connection, like ping and auth, use the empty stream.
+//
+// The frame is not compatible with the legacy format (<flag><payload>) without stream,
+// so the client and server must be upgraded together.
+func EncodeFrame(flag byte, stream string, payload []byte) []byte {
+	frame := make([]byte, 0, 2+len(stream)+len(payload))
+	frame = append(frame, flag, byte(len(stream)))
+	frame = append(frame, stream...)
+	return append(frame, payload...)
+}
+
+// DecodeFrame decodes the message into flag, stream and payload.
+func DecodeFrame(message []byte) (flag byte, stream string, payload []byte, err error) {
+	if len(message) < 2 {
+		return 0, "", nil, fmt.Errorf("invalid frame: too short")
+	}
+
+	length := int(message[1])
+	if len(message) < 2+length {
+		return 0, "", nil, fmt.Errorf("invalid frame: stream length %d out of range", length)
+	}
+
+	return message[0], string(message[2 : 2+length]), message[2+length:], nil
+}
+
+// MaxStreamLength is the max length of stream id
+const MaxStreamLength = 255
@@ -0,0 +1,50 @@
+package entities
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	testcases := []struct {
+		flag    byte
+		stream  string
+		payload []byte
+	}{
+		{MessagePing, "", nil},
+		{MessageCommand, "1", []byte(`{"script":"echo hello"}`)},
+		{MessageCommandStdout, "stream-a", []byte("hello\n")},
+		{MessageCommandStdin, strings.Repeat("s", MaxStreamLength), []byte{0, 1, 2}},
+		{MessageCommandExitCode, "", []byte(`{"code":0}`)},
+	}
+
+	for _, tc := range testcases {
+		flag, stream, payload, err := DecodeFrame(EncodeFrame(tc.flag, tc.stream, tc.payload))
+		if err != nil {
+			t.Fatalf("failed to decode frame(%c, %s): %s", tc.flag, tc.stream, err)
+		}
+
+		if flag != tc.flag || stream != tc.stream || !bytes.Equal(payload, tc.payload) {
+			t.Fatalf("expected (%c, %q, %q), got (%c, %q, %q)", tc.flag, tc.stream, tc.payload, flag, stream, payload)
+		}
+	}
+}
+
+func TestDecodeFrameMalformed(t *testing.T) {
+	testcases := map[string][]byte{
+		"empty":                  {},
+		"flag only":              {MessagePing},
+		"legacy exit code":       {MessageCommandExitCode, 1},
+		"stream length overflow": {MessageCommandStdout, 10, 'a', 'b'},
+		"stream length max":      append([]byte{MessageCommandStdout, 255}, strings.Repeat("a", 254)...),
+	}
+
+	for name, message := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if _, _, _, err := DecodeFrame(message); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
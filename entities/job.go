@@ -0,0 +1,68 @@
+package entities
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Job is the record of job, the times are in UTC
+type Job struct {
+	ID       string `json:"id"`
+	ClientID string `json:"client_id,omitempty"`
+	// Instance is the id of server instance which runs the job
+	Instance string `json:"instance,omitempty"`
+	// Attempt is the attempt of job, which is increased when run again by force, 0 means the first
+	Attempt int `json:"attempt,omitempty"`
+	//
+	Script     string `json:"script"`
+	ScriptHash string `json:"script_hash"`
+	// Template is the name of command template which renders the script
+	Template string `json:"template,omitempty"`
+	// EnvKeys is the keys of environment, the values are not recorded
+	EnvKeys []string `json:"env_keys"`
+	Engine  string   `json:"engine,omitempty"`
+	Image   string   `json:"image,omitempty"`
+	// WorkDir is the workdir of attempt, which may be under the custom workdir base of command
+	WorkDir string `json:"workdir,omitempty"`
+	//
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Exit is the exit of finished job, which has the exit code, signal and duration
+	Exit *Exit `json:"exit,omitempty"`
+	//
+	StdoutBytes int64 `json:"stdout_bytes"`
+	StderrBytes int64 `json:"stderr_bytes"`
+	// LogSize is the size of log in bytes
+	LogSize int64 `json:"log_size"`
+	// LogVersion is the format of log, see LogVersion
+	LogVersion int `json:"log_version,omitempty"`
+	// LogIndex is the checkpoints of log, which is recorded when the job finishes
+	LogIndex []*LogCheckpoint `json:"log_index,omitempty"`
+}
+
+// HashScript returns the sha256 of script in hex.
+func HashScript(script string) string {
+	hash := sha256.Sum256([]byte(script))
+	return hex.EncodeToString(hash[:])
+}
+
+// JobStatusQueued means the job is waiting in queue
+const JobStatusQueued = "queued"
+
+// JobStatusRunning means the job is running
+const JobStatusRunning = "running"
+
+// JobStatusSuccess means the job succeed
+const JobStatusSuccess = "success"
+
+// JobStatusFailure means the job failed
+const JobStatusFailure = "failure"
+
+// JobStatusInterrupted means the job was interrupted by server shutdown or crash
+const JobStatusInterrupted = "interrupted"
+
+// JobStatusUnknown means the job is not running and has no status
+const JobStatusUnknown = "unknown"
@@ -0,0 +1,67 @@
+package entities
+
+import (
+	"encoding/base64"
+	"time"
+	"unicode/utf8"
+)
+
+// LogEntry is a line of job log in json lines
+type LogEntry struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Data   string    `json:"data"`
+	// Encoding is base64 if the data is not valid utf-8, empty means plain text
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// LogVersion is the version of log in json lines of entries, the log of version 0 is the raw output of legacy jobs
+const LogVersion = 1
+
+// LogCheckpoint is the position in log of the entry whose output starts at offset, which is used to seek the log
+type LogCheckpoint struct {
+	Offset   int64 `json:"offset"`
+	Position int64 `json:"position"`
+}
+
+// LogStreamStdout is the stream of stdout
+const LogStreamStdout = "stdout"
+
+// LogStreamStderr is the stream of stderr
+const LogStreamStderr = "stderr"
+
+// LogStreamMarker is the stream of server marker, like truncation, which is not the output of command
+const LogStreamMarker = "marker"
+
+// NewLogEntry creates a log entry of stream at now in UTC.
+func NewLogEntry(stream string, p []byte) *LogEntry {
+	return NewLogEntryAt(time.Now().UTC(), stream, p)
+}
+
+// NewLogEntryAt creates a log entry of stream at t, the binary data is encoded in base64.
+func NewLogEntryAt(t time.Time, stream string, p []byte) *LogEntry {
+	entry := &LogEntry{
+		Time:   t,
+		Stream: stream,
+	}
+
+	if utf8.Valid(p) {
+		entry.Data = string(p)
+	} else {
+		entry.Data = base64.StdEncoding.EncodeToString(p)
+		entry.Encoding = "base64"
+	}
+
+	return entry
+}
+
+// Bytes returns the decoded data.
+func (e *LogEntry) Bytes() []byte {
+	if e.Encoding == "base64" {
+		if p, err := base64.StdEncoding.DecodeString(e.Data); err == nil {
+			return p
+		}
+	}
+
+	return []byte(e.Data)
+}
@@ -21,5 +21,32 @@ const MessageCommandStdout = '5'
 // MessageCommandStderr is the message for command stderr
 const MessageCommandStderr = '6'
 
-// MessageCommandExitCode is the message for command exit code
+// MessageCommandExitCode is the message for command exit, the payload is Exit in json
 const MessageCommandExitCode = '7'
+
+// MessageCommandStdin is the message for command stdin
+const MessageCommandStdin = '8'
+
+// MessageCommandStdinEOF is the message for command stdin eof
+const MessageCommandStdinEOF = '9'
+
+// MessageTerminalResize is the message for terminal resize
+const MessageTerminalResize = 'a'
+
+// MessageTerminalInput is the message for terminal input (keystrokes)
+const MessageTerminalInput = 'b'
+
+// MessageCommandSignal is the message for command signal, the payload is the signal name, like SIGTERM
+const MessageCommandSignal = 'c'
+
+// MessageCommandDetached is the message for detached command, the payload is the job id
+const MessageCommandDetached = 'd'
+
+// MessageCommandAttach is the message for attach to job, the payload is Attach in json
+const MessageCommandAttach = 'e'
+
+// MessageCommandQueued is the message for command waiting in queue, the payload is Queue in json
+const MessageCommandQueued = 'f'
+
+// MessageServerShutdown is the message for server shutting down, the payload is the message
+const MessageServerShutdown = 'g'
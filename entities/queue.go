@@ -0,0 +1,7 @@
+package entities
+
+// Queue is the payload of MessageCommandQueued
+type Queue struct {
+	// Position is the position in the waiting queue, starts from 1
+	Position int `json:"position"`
+}
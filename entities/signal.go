@@ -0,0 +1,33 @@
+package entities
+
+import (
+	"os"
+	"syscall"
+)
+
+// ExitSignalName returns the name of the signal which terminated the command, like SIGSEGV,
+// or the description of signal if unknown.
+func ExitSignalName(sig syscall.Signal) string {
+	if name := SignalName(sig); name != "" {
+		return name
+	}
+
+	for name, s := range exitSignals {
+		if s == sig {
+			return name
+		}
+	}
+
+	return sig.String()
+}
+
+// SignalName returns the name of the signal, like SIGTERM, or empty if not supported.
+func SignalName(sig os.Signal) string {
+	for name, s := range Signals {
+		if s == sig {
+			return name
+		}
+	}
+
+	return ""
+}
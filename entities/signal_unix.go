@@ -0,0 +1,33 @@
+//go:build unix
+
+package entities
+
+import "syscall"
+
+// Signals is the signals which can be sent to the command, keyed by name
+var Signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTSTP": syscall.SIGTSTP,
+	"SIGCONT": syscall.SIGCONT,
+}
+
+// exitSignals is the other signals which may terminate the command, keyed by name
+var exitSignals = map[string]syscall.Signal{
+	"SIGABRT": syscall.SIGABRT,
+	"SIGALRM": syscall.SIGALRM,
+	"SIGBUS":  syscall.SIGBUS,
+	"SIGFPE":  syscall.SIGFPE,
+	"SIGILL":  syscall.SIGILL,
+	"SIGPIPE": syscall.SIGPIPE,
+	"SIGSEGV": syscall.SIGSEGV,
+	"SIGSYS":  syscall.SIGSYS,
+	"SIGTRAP": syscall.SIGTRAP,
+	"SIGXCPU": syscall.SIGXCPU,
+	"SIGXFSZ": syscall.SIGXFSZ,
+}
@@ -0,0 +1,25 @@
+package entities
+
+import "syscall"
+
+// Signals is the signals which can be sent to the command, keyed by name.
+// The signals of unix only, like SIGUSR1, are not defined on windows.
+var Signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// exitSignals is the other signals which may terminate the command, keyed by name
+var exitSignals = map[string]syscall.Signal{
+	"SIGABRT": syscall.SIGABRT,
+	"SIGALRM": syscall.SIGALRM,
+	"SIGBUS":  syscall.SIGBUS,
+	"SIGFPE":  syscall.SIGFPE,
+	"SIGILL":  syscall.SIGILL,
+	"SIGPIPE": syscall.SIGPIPE,
+	"SIGSEGV": syscall.SIGSEGV,
+	"SIGTRAP": syscall.SIGTRAP,
+}
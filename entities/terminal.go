@@ -0,0 +1,7 @@
+package entities
+
+// TerminalSize is the request for terminal resize
+type TerminalSize struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
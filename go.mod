@@ -8,11 +8,13 @@ require (
 	github.com/go-zoox/datetime v1.2.2
 	github.com/go-zoox/fetch v1.8.1
 	github.com/go-zoox/fs v1.3.14
+	github.com/go-zoox/kv v1.5.9
 	github.com/go-zoox/logger v1.4.6
 	github.com/go-zoox/safe v1.0.1
 	github.com/go-zoox/terminal v1.6.8
 	github.com/go-zoox/websocket v0.0.19
 	github.com/go-zoox/zoox v1.13.4
+	github.com/gorilla/websocket v1.5.1
 )
 
 require (
@@ -49,7 +51,6 @@ require (
 	github.com/go-zoox/jobqueue v1.0.0 // indirect
 	github.com/go-zoox/jsonrpc v1.2.2 // indirect
 	github.com/go-zoox/jwt v1.3.0 // indirect
-	github.com/go-zoox/kv v1.5.9 // indirect
 	github.com/go-zoox/mq v1.0.1 // indirect
 	github.com/go-zoox/proxy v1.5.6 // indirect
 	github.com/go-zoox/pubsub v1.2.2 // indirect
@@ -61,7 +62,6 @@ require (
 	github.com/goccy/go-yaml v1.11.2 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/google/uuid v1.5.0 // indirect
-	github.com/gorilla/websocket v1.5.1 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/moby/term v0.5.0 // indirect
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+	"github.com/go-zoox/logger"
+	"github.com/go-zoox/zoox"
+)
+
+func createAPIService(cfg *Config, jobs *JobManager, janitor *Janitor) func(app *zoox.Application) {
+	authenticator := createAuthenticator(cfg)
+	isAuthRequired := cfg.IsAuthRequired()
+
+	// auth by client certificate, bearer token (jwt), or basic auth with client id and secret, same as websocket.
+	// the identity is kept in the context of request, see getIdentity.
+	authenticated := func(handler func(ctx *zoox.Context)) func(ctx *zoox.Context) {
+		return func(ctx *zoox.Context) {
+			identity := &Identity{}
+			if certIdentity := getCertIdentity(ctx.Request); certIdentity != nil {
+				identity = certIdentity
+			} else if isAuthRequired {
+				auth := &entities.AuthRequest{}
+				if authorization := ctx.Request.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+					auth.Token = strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+				} else {
+					clientID, clientSecret, ok := ctx.Request.BasicAuth()
+					if !ok {
+						ctx.Set("WWW-Authenticate", `Basic realm="go-zoox"`)
+						fail(ctx, http.StatusUnauthorized, "unauthorized")
+						return
+					}
+
+					auth.ClientID, auth.ClientSecret = clientID, clientSecret
+				}
+
+				var err error
+				if identity, err = authenticator(auth); err != nil {
+					logger.Errorf("[api] failed to authenticate => %v", err)
+					fail(ctx, http.StatusUnauthorized, fmt.Sprintf("failed to authenticate: %s", err))
+					return
+				}
+			}
+
+			ctx.Request = ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), identityContextKey{}, identity))
+			handler(ctx)
+		}
+	}
+
+	// the operation requires its scope, see Identity.Allows
+	scoped := func(scope string, handler func(ctx *zoox.Context)) func(ctx *zoox.Context) {
+		return authenticated(func(ctx *zoox.Context) {
+			if !getIdentity(ctx).Allows(scope) {
+				fail(ctx, http.StatusForbidden, fmt.Sprintf("permission denied: %s scope is required", scope))
+				return
+			}
+
+			handler(ctx)
+		})
+	}
+
+	return func(app *zoox.Application) {
+		// GET /jobs?status=&keyword=&page=&page_size=
+		app.Get(cfg.APIPath+"/jobs", scoped(ScopeRead, func(ctx *zoox.Context) {
+			query := ctx.Request.URL.Query()
+			page, _ := strconv.Atoi(query.Get("page"))
+			pageSize, _ := strconv.Atoi(query.Get("page_size"))
+			filter := &JobFilter{
+				Identity: getIdentity(ctx),
+				Status:   query.Get("status"),
+				Keyword:  query.Get("keyword"),
+				Page:     page,
+				PageSize: pageSize,
+			}
+
+			total, data, err := listJobs(jobs, filter)
+			if err != nil {
+				fail(ctx, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			success(ctx, map[string]any{
+				"total":     total,
+				"page":      filter.Page,
+				"page_size": filter.PageSize,
+				"data":      data,
+			})
+		}))
+
+		// GET /jobs/:id?attempt=
+		// attempt is the previous attempt of job which is run again by force, default is the current attempt.
+		app.Get(cfg.APIPath+"/jobs/:id", scoped(ScopeRead, func(ctx *zoox.Context) {
+			id := ctx.Param().Get("id").String()
+			if !isValidJobID(id) {
+				fail(ctx, http.StatusBadRequest, "invalid job id")
+				return
+			}
+
+			attempt, _ := strconv.Atoi(ctx.Request.URL.Query().Get("attempt"))
+			job, err := readJobAttempt(jobs, getIdentity(ctx), id, attempt)
+			if err != nil {
+				fail(ctx, http.StatusNotFound, err.Error())
+				return
+			}
+
+			success(ctx, job)
+		}))
+
+		// GET /jobs/:id/log?offset=&tail=&download=&format=&attempt=
+		// offset is the byte offset of output to read from, tail is the last n lines,
+		// format is text (default) or jsonl, which keeps the stream and time of each chunk,
+		// attempt is the previous attempt of job, default is the current attempt.
+		app.Get(cfg.APIPath+"/jobs/:id/log", scoped(ScopeRead, func(ctx *zoox.Context) {
+			id := ctx.Param().Get("id").String()
+			if !isValidJobID(id) {
+				fail(ctx, http.StatusBadRequest, "invalid job id")
+				return
+			}
+
+			query := ctx.Request.URL.Query()
+			attempt, _ := strconv.Atoi(query.Get("attempt"))
+			job, err := readJobAttempt(jobs, getIdentity(ctx), id, attempt)
+			if err != nil {
+				fail(ctx, http.StatusNotFound, err.Error())
+				return
+			}
+
+			offset, _ := strconv.ParseInt(query.Get("offset"), 10, 64)
+			tail, _ := strconv.Atoi(query.Get("tail"))
+
+			isJSONLines := query.Get("format") == "jsonl"
+
+			// the current attempt is read from the log of job
+			if attempt == getArchivedAttempt(job) {
+				attempt = 0
+			}
+			content, err := readLog(jobs.Store(), job, attempt, offset, tail, isJSONLines)
+			if err != nil {
+				fail(ctx, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			ctx.Set("Content-Type", "text/plain; charset=utf-8")
+			if isJSONLines {
+				ctx.Set("Content-Type", "application/x-ndjson")
+			}
+			if query.Get("download") != "" {
+				filename := fmt.Sprintf("%s.log", id)
+				if isJSONLines {
+					filename = fmt.Sprintf("%s.jsonl", id)
+				}
+				ctx.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+			}
+			ctx.Status(http.StatusOK)
+			ctx.Writer.Write(content)
+		}))
+
+		// POST /purge
+		// purges the finished jobs by the retention policy in body, or the policy of config if empty.
+		// only admin can purge if auth is required, as the jobs of all clients are purged.
+		app.Post(cfg.APIPath+"/purge", authenticated(func(ctx *zoox.Context) {
+			if isAuthRequired && !getIdentity(ctx).IsAdmin() {
+				fail(ctx, http.StatusForbidden, fmt.Sprintf("permission denied: purge requires %s scope or role", ScopeAdmin))
+				return
+			}
+
+			policy := &RetentionPolicy{}
+			if ctx.Request.ContentLength != 0 {
+				if err := json.NewDecoder(ctx.Request.Body).Decode(policy); err != nil {
+					fail(ctx, http.StatusBadRequest, fmt.Sprintf("invalid retention policy: %s", err))
+					return
+				}
+			}
+			if policy.IsEmpty() {
+				policy = cfg.GetRetentionPolicy()
+			}
+			if policy.IsEmpty() {
+				fail(ctx, http.StatusBadRequest, "retention policy is required")
+				return
+			}
+
+			logger.Infof("[api] purge jobs: %+v", policy)
+			result, err := janitor.Purge(policy)
+			if err != nil {
+				fail(ctx, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			success(ctx, result)
+		}))
+
+		// POST /exec?stream=
+		// runs the command synchronously, the result is returned when the command is finished,
+		// or the output is streamed as json lines with stream.
+		app.Post(cfg.APIPath+"/exec", scoped(ScopeExec, func(ctx *zoox.Context) {
+			commandN := &entities.Command{}
+			if err := json.NewDecoder(ctx.Request.Body).Decode(commandN); err != nil {
+				fail(ctx, http.StatusBadRequest, fmt.Sprintf("invalid command request: %s", err))
+				return
+			}
+			if commandN.TTY || commandN.Stdin {
+				fail(ctx, http.StatusBadRequest, "http exec does not support tty or stdin")
+				return
+			}
+
+			// the job is finished by runJob, as the detached job is still running after the response
+			job := NewJob("")
+			job.Identity = getIdentity(ctx)
+			job.ClientID = job.Identity.ClientID
+			job.ID = fmt.Sprintf("http_%d", time.Now().UnixNano())
+			job.CommandN = commandN
+
+			if commandN.Detached {
+				viewer := newBufferViewer(getExecOutputSize(cfg))
+				detachedCh := make(chan string, 1)
+				finishedCh := make(chan struct{})
+				go func() {
+					defer close(finishedCh)
+					runJob(cfg, jobs, job, viewer, func(id string) {
+						detachedCh <- id
+					})
+				}()
+
+				select {
+				case id := <-detachedCh:
+					success(ctx, map[string]any{"id": id})
+				case <-finishedCh:
+					select {
+					case id := <-detachedCh:
+						success(ctx, map[string]any{"id": id})
+					default:
+						fail(ctx, http.StatusBadRequest, strings.TrimSpace(viewer.Result(job.ID).Stderr))
+					}
+				}
+				return
+			}
+
+			// the job is killed when the caller goes away
+			finishedCh := make(chan struct{})
+			defer close(finishedCh)
+			go func() {
+				select {
+				case <-ctx.Request.Context().Done():
+					job.Cancel()
+				case <-finishedCh:
+				}
+			}()
+
+			if ctx.Request.URL.Query().Get("stream") != "" {
+				logger.Infof("[api] exec in stream: %s", commandN.Script)
+				ctx.Set("Content-Type", "application/x-ndjson")
+				ctx.Status(http.StatusOK)
+				runJob(cfg, jobs, job, &streamViewer{writer: ctx.Writer}, nil)
+				return
+			}
+
+			logger.Infof("[api] exec: %s", commandN.Script)
+			viewer := newBufferViewer(getExecOutputSize(cfg))
+			runJob(cfg, jobs, job, viewer, nil)
+			success(ctx, viewer.Result(job.ID))
+		}))
+
+		// GET /jobs/:id/events?offset=
+		// streams the output of job as server-sent events, resumed by Last-Event-ID.
+		app.Get(cfg.APIPath+"/jobs/:id/events", scoped(ScopeRead, func(ctx *zoox.Context) {
+			id := ctx.Param().Get("id").String()
+			if !isValidJobID(id) {
+				fail(ctx, http.StatusBadRequest, "invalid job id")
+				return
+			}
+			if _, err := readJob(jobs, getIdentity(ctx), id); err != nil {
+				fail(ctx, http.StatusNotFound, err.Error())
+				return
+			}
+
+			offset, _ := strconv.ParseInt(ctx.Request.URL.Query().Get("offset"), 10, 64)
+			if lastEventID := ctx.Request.Header.Get("Last-Event-ID"); lastEventID != "" {
+				offset, _ = strconv.ParseInt(lastEventID, 10, 64)
+			}
+
+			ctx.Set("Content-Type", "text/event-stream")
+			ctx.Set("Cache-Control", "no-cache")
+			ctx.Set("Connection", "keep-alive")
+			ctx.Set("X-Accel-Buffering", "no")
+			ctx.Status(http.StatusOK)
+
+			viewer := newSSEViewer(ctx.Writer, offset, cfg.MaxLogSize)
+			defer viewer.Close()
+
+			logger.Infof("[api] watch job events: %s (offset: %d)", id, offset)
+			if err := attachJob(jobs, getIdentity(ctx), &entities.Attach{ID: id, Offset: offset}, viewer); err != nil {
+				logger.Errorf("[api] failed to watch job events: %s", err)
+				return
+			}
+
+			ticker := time.NewTicker(15 * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-viewer.Done():
+					return
+				case <-ctx.Request.Context().Done():
+					return
+				case <-ticker.C:
+					if err := viewer.Ping(); err != nil {
+						return
+					}
+				}
+			}
+		}))
+
+		// POST /jobs/:id/cancel
+		app.Post(cfg.APIPath+"/jobs/:id/cancel", scoped(ScopeCancel, func(ctx *zoox.Context) {
+			id := ctx.Param().Get("id").String()
+			job := jobs.Get(id)
+			if job == nil || !getIdentity(ctx).CanAccess(job.ClientID) {
+				fail(ctx, http.StatusNotFound, fmt.Sprintf("job(%s) is not running", id))
+				return
+			}
+
+			logger.Infof("[api] cancel job: %s", id)
+			if err := job.Cancel(); err != nil {
+				fail(ctx, http.StatusInternalServerError, fmt.Sprintf("failed to cancel job: %s", err))
+				return
+			}
+
+			success(ctx, nil)
+		}))
+	}
+}
+
+// readLog reads the log of job from the output offset, or the last n lines if tail is not zero.
+// The log is plain text of output with truncation markers, or json lines of entries if isJSONLines.
+// The attempt is the archived attempt of record, 0 means the current attempt.
+func readLog(store JobStore, record *entities.Job, attempt int, offset int64, tail int, isJSONLines bool) ([]byte, error) {
+	lines := []string{}
+	buf := &bytes.Buffer{}
+	fn := func(entry *entities.LogEntry, data []byte) error {
+		if !isJSONLines {
+			buf.Write(data)
+			return nil
+		}
+
+		line, err := json.Marshal(entities.NewLogEntryAt(entry.Time, entry.Stream, data))
+		if err != nil {
+			return err
+		}
+
+		lines = append(lines, string(line)+"\n")
+		return nil
+	}
+
+	var err error
+	if attempt == 0 {
+		err = readLogEntries(store, record, offset, -1, fn)
+	} else {
+		err = readAttemptLogEntries(store, record, attempt, offset, -1, fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !isJSONLines {
+		lines = strings.SplitAfter(buf.String(), "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+	}
+
+	if tail > 0 && len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// identityContextKey is the key of identity in the context of request
+type identityContextKey struct{}
+
+// getIdentity returns the identity of authenticated request.
+func getIdentity(ctx *zoox.Context) *Identity {
+	if identity, ok := ctx.Request.Context().Value(identityContextKey{}).(*Identity); ok {
+		return identity
+	}
+
+	return &Identity{}
+}
+
+// success responses the result in the same shape of auth service.
+func success(ctx *zoox.Context, result any) {
+	ctx.JSON(http.StatusOK, map[string]any{
+		"code":    200,
+		"message": "ok",
+		"result":  result,
+	})
+}
+
+func fail(ctx *zoox.Context, status int, message string) {
+	ctx.JSON(status, map[string]any{
+		"code":    status,
+		"message": message,
+	})
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// attachJob replays the log of job from offset, and then follows the live output until exit if it is running.
+// The job of other clients is not found, unless the identity is admin.
+func attachJob(jobs *JobManager, identity *Identity, attach *entities.Attach, viewer Viewer) error {
+	store := jobs.Store()
+	record, err := readJob(jobs, identity, attach.ID)
+	if err != nil {
+		return err
+	}
+
+	if job := jobs.Get(attach.ID); job != nil {
+		// subscribe before replay, the live output is pending until the replay is finished
+		pending := newPendingViewer(viewer)
+		if logSize, ok := job.Subscribe(pending); ok {
+			if err := replayLog(store, record, attach.Offset, logSize, viewer); err != nil {
+				job.Unsubscribe(pending)
+				return fmt.Errorf("failed to replay log: %s", err)
+			}
+
+			return pending.Ready()
+		}
+	}
+
+	// finished
+	if err := replayLog(store, record, attach.Offset, -1, viewer); err != nil {
+		return fmt.Errorf("failed to replay log: %s", err)
+	}
+
+	record, err = store.Get(attach.ID)
+	if err != nil {
+		return fmt.Errorf("job(%s) not found", attach.ID)
+	}
+
+	return viewer.WriteExit(readExit(record))
+}
+
+// readExit reads the exit of finished job from its record.
+func readExit(record *entities.Job) *entities.Exit {
+	if record.Exit != nil {
+		return record.Exit
+	}
+
+	return &entities.Exit{Code: -1, Reason: entities.ExitReasonInternalError, Message: "job is not running and has no status"}
+}
@@ -3,19 +3,200 @@ package server
 import (
 	"fmt"
 
+	"github.com/go-zoox/command/engine/host"
 	caas "github.com/go-zoox/commands-as-a-service"
+	"github.com/go-zoox/commands-as-a-service/entities"
 	"github.com/go-zoox/fetch"
 )
 
-func createAuthenticator(cfg *Config) func(clientID, clientSecret string) (err error) {
-	return func(clientID, clientSecret string) (err error) {
+// Identity is the authenticated client of connection or request
+type Identity struct {
+	ClientID string
+	// Subject is the sub of jwt
+	Subject string
+	// Scopes is the scopes of jwt
+	Scopes []string
+	// Roles is the roles of jwt or auth service, which are used by policy
+	Roles []string
+	// Claims is all the claims of jwt
+	Claims map[string]any
+	//
+	// Engines is the allowed engines of client by auth service, empty means not limited
+	Engines []string
+	// MaxCPU and MaxMemory cap the resources of commands by auth service, 0 means unlimited
+	MaxCPU    float64
+	MaxMemory int64
+	// Environment is the extra environment of commands by auth service
+	Environment map[string]string
+	// WorkDirBase is the workdir base of commands by auth service, the command may only use the dirs under it
+	WorkDirBase string
+}
+
+// AuthResult is the optional result of auth service response, which is applied to the commands of client
+type AuthResult struct {
+	Scopes      []string          `json:"scopes"`
+	Roles       []string          `json:"roles"`
+	Engines     []string          `json:"engines"`
+	MaxCPU      float64           `json:"max_cpu"`
+	MaxMemory   int64             `json:"max_memory"`
+	Environment map[string]string `json:"environment"`
+	WorkDirBase string            `json:"workdir_base"`
+}
+
+// ScopeAdmin is the scope (or role) of admin, who can access the jobs of all clients and purge jobs
+const ScopeAdmin = "admin"
+
+// ScopeExec is the scope to run commands
+const ScopeExec = "exec"
+
+// ScopeRead is the scope to read jobs, their logs and events
+const ScopeRead = "read"
+
+// ScopeCancel is the scope to cancel jobs
+const ScopeCancel = "cancel"
+
+// caasScopes is the scopes of caas, the other scopes (like openid of jwt) are ignored
+var caasScopes = []string{ScopeAdmin, ScopeExec, ScopeRead, ScopeCancel}
+
+// IsAdmin returns whether the identity has the admin scope or role.
+func (i *Identity) IsAdmin() bool {
+	if i.HasScope(ScopeAdmin) {
+		return true
+	}
+
+	for _, role := range i.Roles {
+		if role == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CanAccess returns whether the identity can access the job of client, only the owner and admin can.
+func (i *Identity) CanAccess(clientID string) bool {
+	return i.IsAdmin() || i.ClientID == clientID
+}
+
+// Allows returns whether the identity is allowed the operation of scope.
+// The identity without any scope of caas is not limited by scopes, like the static client,
+// otherwise it must have the scope, or be admin.
+func (i *Identity) Allows(scope string) bool {
+	if i.IsAdmin() || i.HasScope(scope) {
+		return true
+	}
+
+	for _, s := range caasScopes {
+		if i.HasScope(s) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// HasScope returns whether the identity has the scope.
+func (i *Identity) HasScope(scope string) bool {
+	for _, s := range i.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply applies the limits and environment of auth service to the command,
+// returns the denial if the command is out of limits.
+func (i *Identity) Apply(command *entities.Command) error {
+	if len(i.Engines) != 0 {
+		engine := command.Engine
+		if engine == "" {
+			engine = host.Name
+		}
+		if !matchPolicy(i.Engines, engine, host.Name) {
+			return fmt.Errorf("permission denied: client(%s) does not allow engine: %s", i.ClientID, engine)
+		}
+	}
+
+	if i.MaxCPU != 0 {
+		if command.CPU > i.MaxCPU {
+			return fmt.Errorf("permission denied: client(%s) does not allow cpu %v (max: %v)", i.ClientID, command.CPU, i.MaxCPU)
+		}
+		if command.CPU == 0 {
+			command.CPU = i.MaxCPU
+		}
+	}
+
+	if i.MaxMemory != 0 {
+		if command.Memory > i.MaxMemory {
+			return fmt.Errorf("permission denied: client(%s) does not allow memory %d (max: %d)", i.ClientID, command.Memory, i.MaxMemory)
+		}
+		if command.Memory == 0 {
+			command.Memory = i.MaxMemory
+		}
+	}
+
+	if i.WorkDirBase != "" {
+		if command.WorkDirBase == "" {
+			command.WorkDirBase = i.WorkDirBase
+		} else if !isUnderRoots([]string{i.WorkDirBase}, command.WorkDirBase) {
+			return fmt.Errorf("permission denied: client(%s) does not allow workdir base: %s", i.ClientID, command.WorkDirBase)
+		}
+	}
+
+	if len(i.Environment) != 0 {
+		// the environment of client overrides the command
+		environment := map[string]string{}
+		for k, v := range command.Environment {
+			environment[k] = v
+		}
+		for k, v := range i.Environment {
+			environment[k] = v
+		}
+		command.Environment = environment
+	}
+
+	return nil
+}
+
+// Authenticator authenticates the auth request, returns the identity of client
+type Authenticator func(auth *entities.AuthRequest) (*Identity, error)
+
+func createAuthenticator(cfg *Config) Authenticator {
+	var verifier *jwtVerifier
+	var verifierErr error
+	if cfg.IsJWTEnabled() {
+		verifier, verifierErr = newJWTVerifier(cfg)
+	}
+
+	return func(auth *entities.AuthRequest) (*Identity, error) {
+		clientID, clientSecret := auth.ClientID, auth.ClientSecret
+
+		// jwt auth
+		if auth.Token != "" {
+			if !cfg.IsJWTEnabled() {
+				return nil, fmt.Errorf("token auth is not enabled")
+			}
+			if verifierErr != nil {
+				return nil, fmt.Errorf("failed to load jwt keys: %s", verifierErr)
+			}
+
+			identity, err := verifier.Verify(auth.Token)
+			if err != nil {
+				return nil, fmt.Errorf("failed to verify token: %s", err)
+			}
+
+			return identity, nil
+		}
+
 		// static auth
 		if cfg.ClientID != "" && cfg.ClientSecret != "" {
 			if clientID != cfg.ClientID || clientSecret != cfg.ClientSecret {
-				return fmt.Errorf("invalid client id or secret")
+				return nil, fmt.Errorf("invalid client id or secret")
 			}
 
-			return nil
+			return &Identity{ClientID: clientID}, nil
 		}
 
 		if cfg.AuthService != "" {
@@ -38,7 +219,17 @@ func createAuthenticator(cfg *Config) func(clientID, clientSecret string) (err e
 			//   Body:
 			//   	{
 			//			"code": 200,
-			//     	"message": "ok"
+			//     	"message": "ok",
+			//			// optional, see AuthResult, the scopes are admin, exec, read and cancel (see Identity.Allows)
+			//			"result": {
+			//				"scopes": ["exec"],
+			//				"roles": ["dev"],
+			//				"engines": ["docker"],
+			//				"max_cpu": 1,
+			//				"max_memory": 1024,
+			//				"environment": { "TEAM": "a" },
+			//				"workdir_base": "/data/team-a"
+			//			}
 			//   	}
 			//
 			response, err := fetch.Post(cfg.AuthService, &fetch.Config{
@@ -54,11 +245,11 @@ func createAuthenticator(cfg *Config) func(clientID, clientSecret string) (err e
 				},
 			})
 			if err != nil {
-				return fmt.Errorf("failed to communicate with auth service(%s): %s", cfg.AuthService, err)
+				return nil, fmt.Errorf("failed to communicate with auth service(%s): %s", cfg.AuthService, err)
 			}
 
 			if response.Status != 200 {
-				return fmt.Errorf("failed to authenticate by response status(%d): %s", response.Status, response.String())
+				return nil, fmt.Errorf("failed to authenticate by response status(%d): %s", response.Status, response.String())
 			}
 
 			code := response.Get("code").Int()
@@ -68,12 +259,36 @@ func createAuthenticator(cfg *Config) func(clientID, clientSecret string) (err e
 					message = fmt.Sprintf("unknown error (%s)", response.String())
 				}
 
-				return fmt.Errorf("[%d] %s", code, message)
+				return nil, fmt.Errorf("[%d] %s", code, message)
+			}
+
+			// the result is optional, but the invalid result is rejected, as its limits would be lost
+			body := &struct {
+				Result *AuthResult `json:"result"`
+			}{}
+			if err := response.UnmarshalJSON(body); err != nil {
+				return nil, fmt.Errorf("invalid auth service result: %s", err)
 			}
+			result := body.Result
+
+			identity := &Identity{ClientID: clientID, Scopes: []string{}}
+			if result != nil {
+				identity.Scopes = append(identity.Scopes, result.Scopes...)
+				identity.Roles = result.Roles
+				identity.Engines = result.Engines
+				identity.MaxCPU = result.MaxCPU
+				identity.MaxMemory = result.MaxMemory
+				identity.Environment = result.Environment
+				identity.WorkDirBase = result.WorkDirBase
+			}
+
+			return identity, nil
+		}
 
-			return nil
+		if cfg.IsJWTEnabled() {
+			return nil, fmt.Errorf("token is required")
 		}
 
-		return nil
+		return &Identity{ClientID: clientID}, nil
 	}
 }
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+func TestAuthServiceResult(t *testing.T) {
+	testcases := []struct {
+		name     string
+		status   int
+		body     string
+		identity *Identity
+		err      string
+	}{
+		{
+			name:     "without result",
+			status:   200,
+			body:     `{"code": 200, "message": "ok"}`,
+			identity: &Identity{ClientID: "client-1", Scopes: []string{}},
+		},
+		{
+			name:   "with result",
+			status: 200,
+			body: `{"code": 200, "message": "ok", "result": {
+				"scopes": ["exec"],
+				"roles": ["dev"],
+				"engines": ["docker"],
+				"max_cpu": 1.5,
+				"max_memory": 1024,
+				"environment": {"TEAM": "a"},
+				"workdir_base": "/data/team-a"
+			}}`,
+			identity: &Identity{
+				ClientID:    "client-1",
+				Scopes:      []string{"exec"},
+				Roles:       []string{"dev"},
+				Engines:     []string{"docker"},
+				MaxCPU:      1.5,
+				MaxMemory:   1024,
+				Environment: map[string]string{"TEAM": "a"},
+				WorkDirBase: "/data/team-a",
+			},
+		},
+		{
+			name:     "null result",
+			status:   200,
+			body:     `{"code": 200, "message": "ok", "result": null}`,
+			identity: &Identity{ClientID: "client-1", Scopes: []string{}},
+		},
+		{
+			name:   "invalid result",
+			status: 200,
+			body:   `{"code": 200, "message": "ok", "result": {"max_cpu": "unlimited"}}`,
+			err:    "invalid auth service result",
+		},
+		{
+			name:   "result is not object",
+			status: 200,
+			body:   `{"code": 200, "message": "ok", "result": "admin"}`,
+			err:    "invalid auth service result",
+		},
+		{
+			name:   "denied by code",
+			status: 200,
+			body:   `{"code": 401, "message": "invalid secret"}`,
+			err:    "[401] invalid secret",
+		},
+		{
+			name:   "denied by status",
+			status: 500,
+			body:   `internal error`,
+			err:    "response status(500)",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Client-ID") != "client-1" || r.Header.Get("X-Client-Secret") != "secret-1" {
+					t.Errorf("unexpected client id or secret: %v", r.Header)
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer service.Close()
+
+			authenticate := createAuthenticator(&Config{AuthService: service.URL})
+			identity, err := authenticate(&entities.AuthRequest{ClientID: "client-1", ClientSecret: "secret-1"})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if !reflect.DeepEqual(identity, tc.identity) {
+				t.Fatalf("expected identity %+v, got %+v", tc.identity, identity)
+			}
+		})
+	}
+}
+
+func TestIdentityApply(t *testing.T) {
+	identity := &Identity{
+		ClientID:    "client-1",
+		Engines:     []string{"docker"},
+		MaxCPU:      2,
+		MaxMemory:   1024,
+		Environment: map[string]string{"TEAM": "a"},
+		WorkDirBase: "/data/team-a",
+	}
+
+	testcases := []struct {
+		name     string
+		command  *entities.Command
+		expected *entities.Command
+		err      string
+	}{
+		{
+			name:    "defaults",
+			command: &entities.Command{Engine: "docker", Environment: map[string]string{"TEAM": "b", "A": "1"}},
+			expected: &entities.Command{
+				Engine:      "docker",
+				CPU:         2,
+				Memory:      1024,
+				WorkDirBase: "/data/team-a",
+				// the environment of client overrides the command
+				Environment: map[string]string{"TEAM": "a", "A": "1"},
+			},
+		},
+		{
+			name:     "within limits",
+			command:  &entities.Command{Engine: "docker", CPU: 1, Memory: 512, WorkDirBase: "/data/team-a/x"},
+			expected: &entities.Command{Engine: "docker", CPU: 1, Memory: 512, WorkDirBase: "/data/team-a/x", Environment: map[string]string{"TEAM": "a"}},
+		},
+		{
+			name:    "engine",
+			command: &entities.Command{},
+			err:     "does not allow engine: host",
+		},
+		{
+			name:    "cpu",
+			command: &entities.Command{Engine: "docker", CPU: 4},
+			err:     "does not allow cpu 4 (max: 2)",
+		},
+		{
+			name:    "memory",
+			command: &entities.Command{Engine: "docker", Memory: 2048},
+			err:     "does not allow memory 2048 (max: 1024)",
+		},
+		{
+			name:    "workdir base",
+			command: &entities.Command{Engine: "docker", WorkDirBase: "/data/team-b"},
+			err:     "does not allow workdir base: /data/team-b",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := identity.Apply(tc.command)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if !reflect.DeepEqual(tc.command, tc.expected) {
+				t.Fatalf("expected command %+v, got %+v", tc.expected, tc.command)
+			}
+		})
+	}
+}
+
+func TestIdentityAllows(t *testing.T) {
+	testcases := []struct {
+		name     string
+		identity *Identity
+		scope    string
+		allowed  bool
+	}{
+		{name: "without caas scopes", identity: &Identity{Scopes: []string{"openid"}}, scope: ScopeExec, allowed: true},
+		{name: "with scope", identity: &Identity{Scopes: []string{ScopeRead}}, scope: ScopeRead, allowed: true},
+		{name: "without scope", identity: &Identity{Scopes: []string{ScopeRead}}, scope: ScopeExec},
+		{name: "cancel without scope", identity: &Identity{Scopes: []string{ScopeExec, ScopeRead}}, scope: ScopeCancel},
+		{name: "admin", identity: &Identity{Scopes: []string{ScopeAdmin}}, scope: ScopeCancel, allowed: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if allowed := tc.identity.Allows(tc.scope); allowed != tc.allowed {
+				t.Fatalf("expected allowed %v of scope %s, got %v", tc.allowed, tc.scope, allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/go-zoox/websocket"
+)
+
+// ConnManager manages the websocket connections of server
+type ConnManager struct {
+	mu    sync.Mutex
+	conns map[string]websocket.Conn
+}
+
+// NewConnManager creates a connection manager.
+func NewConnManager() *ConnManager {
+	return &ConnManager{
+		conns: map[string]websocket.Conn{},
+	}
+}
+
+// Add adds the connection.
+func (m *ConnManager) Add(conn websocket.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.conns[conn.ID()] = conn
+}
+
+// Remove removes the connection.
+func (m *ConnManager) Remove(conn websocket.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.conns, conn.ID())
+}
+
+// List returns all the connections.
+func (m *ConnManager) List() []websocket.Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conns := make([]websocket.Conn, 0, len(m.conns))
+	for _, conn := range m.conns {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// DefaultMaxExecOutputSize is the max bytes of output collected by http exec if MaxLogSize is unlimited
+const DefaultMaxExecOutputSize = 16 * 1024 * 1024
+
+// bufferViewer collects the output and exit of a job, the output over maxSize is dropped and marked truncated.
+type bufferViewer struct {
+	mu        sync.Mutex
+	stdout    bytes.Buffer
+	stderr    bytes.Buffer
+	exit      *entities.Exit
+	maxSize   int64
+	size      int64
+	truncated bool
+}
+
+// newBufferViewer creates the viewer which collects up to maxSize bytes of output.
+func newBufferViewer(maxSize int64) *bufferViewer {
+	return &bufferViewer{
+		maxSize: maxSize,
+	}
+}
+
+func (v *bufferViewer) WriteOutput(flag byte, p []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if rest := v.maxSize - v.size; int64(len(p)) > rest {
+		p = p[:rest]
+		v.truncated = true
+	}
+	v.size += int64(len(p))
+
+	if flag == entities.MessageCommandStderr {
+		v.stderr.Write(p)
+	} else {
+		v.stdout.Write(p)
+	}
+	return nil
+}
+
+func (v *bufferViewer) WriteExit(exit *entities.Exit) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.exit == nil {
+		v.exit = exit
+	}
+	return nil
+}
+
+// Result returns the collected result of the job
+func (v *bufferViewer) Result(id string) *entities.ExecResult {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	result := &entities.ExecResult{
+		ID:        id,
+		Stdout:    v.stdout.String(),
+		Stderr:    v.stderr.String(),
+		Exit:      v.exit,
+		Truncated: v.truncated,
+	}
+	if v.exit != nil {
+		result.ExitCode = v.exit.Code
+	}
+	return result
+}
+
+// getExecOutputSize returns the max bytes of output collected by http exec, which is capped by MaxLogSize.
+func getExecOutputSize(cfg *Config) int64 {
+	if cfg.MaxLogSize > 0 && cfg.MaxLogSize < DefaultMaxExecOutputSize {
+		return cfg.MaxLogSize
+	}
+
+	return DefaultMaxExecOutputSize
+}
+
+// streamViewer writes the output and exit of a job as json lines in chunked response
+type streamViewer struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func (v *streamViewer) WriteOutput(flag byte, p []byte) error {
+	event := &entities.ExecEvent{}
+	if flag == entities.MessageCommandStderr {
+		event.Stderr = string(p)
+	} else {
+		event.Stdout = string(p)
+	}
+	return v.write(event)
+}
+
+func (v *streamViewer) WriteExit(exit *entities.Exit) error {
+	return v.write(&entities.ExecEvent{Exit: exit})
+}
+
+func (v *streamViewer) WriteQueued(queue *entities.Queue) error {
+	return v.write(&entities.ExecEvent{Queued: queue})
+}
+
+func (v *streamViewer) write(event *entities.ExecEvent) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if _, err := v.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if flusher, ok := v.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
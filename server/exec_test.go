@@ -0,0 +1,53 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+func TestBufferViewer(t *testing.T) {
+	testcases := []struct {
+		name      string
+		maxSize   int64
+		stdout    string
+		stderr    string
+		truncated bool
+	}{
+		{name: "under max size", maxSize: 100, stdout: "hello world", stderr: "oops"},
+		{name: "stderr over max size", maxSize: 13, stdout: "hello world", stderr: "oo", truncated: true},
+		{name: "stdout over max size", maxSize: 5, stdout: "hello", truncated: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			viewer := newBufferViewer(tc.maxSize)
+			viewer.WriteOutput(entities.MessageCommandStdout, []byte("hello "))
+			viewer.WriteOutput(entities.MessageCommandStdout, []byte("world"))
+			viewer.WriteOutput(entities.MessageCommandStderr, []byte("oops"))
+			viewer.WriteExit(&entities.Exit{Code: 1, Reason: entities.ExitReasonExited})
+
+			result := viewer.Result("job-1")
+			if result.Stdout != tc.stdout || result.Stderr != tc.stderr || result.Truncated != tc.truncated {
+				t.Fatalf("expected (%q, %q, %v), got (%q, %q, %v)", tc.stdout, tc.stderr, tc.truncated, result.Stdout, result.Stderr, result.Truncated)
+			}
+			if result.ID != "job-1" || result.ExitCode != 1 {
+				t.Fatalf("unexpected result: %+v", result)
+			}
+		})
+	}
+}
+
+func TestGetExecOutputSize(t *testing.T) {
+	testcases := map[int64]int64{
+		0:                            DefaultMaxExecOutputSize,
+		1024:                         1024,
+		DefaultMaxExecOutputSize * 2: DefaultMaxExecOutputSize,
+	}
+
+	for maxLogSize, expected := range testcases {
+		if size := getExecOutputSize(&Config{MaxLogSize: maxLogSize}); size != expected {
+			t.Fatalf("expected size %d of max log size %d, got %d", expected, maxLogSize, size)
+		}
+	}
+}
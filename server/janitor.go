@@ -0,0 +1,219 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+	"github.com/go-zoox/fs"
+	"github.com/go-zoox/logger"
+)
+
+// RetentionPolicy is the retention rules of finished jobs, 0 means unlimited
+type RetentionPolicy struct {
+	// MaxAge is the max age in seconds since the job finished
+	MaxAge int64 `json:"max_age"`
+	// MaxAgeFailed is the max age in seconds of failed jobs, which is used to keep failed jobs longer
+	MaxAgeFailed int64 `json:"max_age_failed"`
+	// MaxJobs is the max count of finished jobs
+	MaxJobs int64 `json:"max_jobs"`
+	// MaxBytes is the max total bytes of log and workdir of finished jobs
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// IsEmpty returns whether the policy has no rule.
+func (p *RetentionPolicy) IsEmpty() bool {
+	return p.MaxAge == 0 && p.MaxAgeFailed == 0 && p.MaxJobs == 0 && p.MaxBytes == 0
+}
+
+// PurgeResult is the result of purge
+type PurgeResult struct {
+	IDs   []string `json:"ids"`
+	Bytes int64    `json:"bytes"`
+}
+
+// Janitor purges the finished jobs by retention policy in background
+type Janitor struct {
+	cfg  *Config
+	jobs *JobManager
+	//
+	mu     sync.Mutex
+	stopCh chan struct{}
+}
+
+// NewJanitor creates a janitor.
+func NewJanitor(cfg *Config, jobs *JobManager) *Janitor {
+	return &Janitor{
+		cfg:  cfg,
+		jobs: jobs,
+	}
+}
+
+// Start starts to purge every RetentionInterval seconds, nothing to do if there is no retention rule.
+func (j *Janitor) Start() {
+	policy := j.cfg.GetRetentionPolicy()
+	if policy.IsEmpty() {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stopCh != nil {
+		return
+	}
+	j.stopCh = make(chan struct{})
+
+	interval := time.Duration(j.cfg.RetentionInterval) * time.Second
+	logger.Infof("[janitor] start (interval: %s)", interval)
+	go func(stopCh chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				if _, err := j.Purge(policy); err != nil {
+					logger.Errorf("[janitor] failed to purge: %s", err)
+				}
+			}
+		}
+	}(j.stopCh)
+}
+
+// Stop stops the janitor.
+func (j *Janitor) Stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.stopCh != nil {
+		close(j.stopCh)
+		j.stopCh = nil
+	}
+}
+
+// Purge removes the record, log and workdir of finished jobs which break the policy.
+func (j *Janitor) Purge(policy *RetentionPolicy) (*PurgeResult, error) {
+	result := &PurgeResult{IDs: []string{}}
+	records, err := j.jobs.Store().List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %s", err)
+	}
+
+	type finishedJob struct {
+		id         string
+		finishedAt time.Time
+		isFailed   bool
+		workDirs   []string
+		size       int64
+	}
+
+	now := time.Now()
+	finished := []*finishedJob{}
+	for _, record := range records {
+		if !isJobFinished(record.Status) || j.jobs.Get(record.ID) != nil {
+			continue
+		}
+
+		job := &finishedJob{
+			id:         record.ID,
+			finishedAt: now,
+			isFailed:   record.Status != entities.JobStatusSuccess,
+			workDirs:   j.getWorkDirs(record),
+			size:       record.LogSize,
+		}
+		for _, workDir := range job.workDirs {
+			job.size += dirSize(workDir)
+		}
+		if record.FinishedAt != nil {
+			job.finishedAt = *record.FinishedAt
+		}
+
+		finished = append(finished, job)
+	}
+
+	// latest first
+	sort.SliceStable(finished, func(a, b int) bool {
+		return finished[a].finishedAt.After(finished[b].finishedAt)
+	})
+
+	count := int64(0)
+	bytes := int64(0)
+	for _, job := range finished {
+		maxAge := policy.MaxAge
+		if job.isFailed && policy.MaxAgeFailed != 0 {
+			maxAge = policy.MaxAgeFailed
+		}
+
+		isExpired := maxAge != 0 && now.Sub(job.finishedAt) > time.Duration(maxAge)*time.Second
+		isOverCount := policy.MaxJobs != 0 && count >= policy.MaxJobs
+		isOverBytes := policy.MaxBytes != 0 && bytes+job.size > policy.MaxBytes
+		if !isExpired && !isOverCount && !isOverBytes {
+			count++
+			bytes += job.size
+			continue
+		}
+
+		if err := j.remove(job.id, job.workDirs); err != nil {
+			logger.Errorf("[janitor] failed to purge job(%s): %s", job.id, err)
+			continue
+		}
+
+		result.IDs = append(result.IDs, job.id)
+		result.Bytes += job.size
+	}
+
+	if len(result.IDs) != 0 {
+		logger.Infof("[janitor] purged %d jobs (%d bytes)", len(result.IDs), result.Bytes)
+	}
+
+	return result, nil
+}
+
+func (j *Janitor) remove(id string, workDirs []string) error {
+	for _, workDir := range workDirs {
+		if fs.IsExist(workDir) {
+			if err := fs.Remove(workDir); err != nil {
+				return fmt.Errorf("failed to remove workdir: %s", err)
+			}
+		}
+	}
+
+	return j.jobs.Store().Delete(id)
+}
+
+// getWorkDirs returns the workdirs of all attempts, which are recorded in the archived attempts.
+func (j *Janitor) getWorkDirs(record *entities.Job) []string {
+	workDirs := []string{}
+	for i := 1; i < record.Attempt; i++ {
+		if attempt, err := j.jobs.Store().GetAttempt(record.ID, i); err == nil {
+			workDirs = append(workDirs, j.cfg.GetJobWorkDir(attempt))
+		} else {
+			workDirs = append(workDirs, j.cfg.GetWorkDir(record.ID, i))
+		}
+	}
+
+	return append(workDirs, j.cfg.GetJobWorkDir(record))
+}
+
+// dirSize returns the total size of files in dir, 0 if not exist.
+func dirSize(dir string) int64 {
+	size := int64(0)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
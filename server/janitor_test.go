@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// createTestFinishedJob creates the job finished at finishedAt, with a log of size bytes.
+func createTestFinishedJob(t *testing.T, store JobStore, id, status string, finishedAt time.Time, size int) {
+	t.Helper()
+
+	job := &entities.Job{ID: id, Status: status}
+	if isJobFinished(status) {
+		job.FinishedAt = &finishedAt
+	}
+
+	if err := store.Create(job); err != nil {
+		t.Fatalf("failed to create job: %s", err)
+	}
+	if err := store.AppendLog(id, []byte(strings.Repeat("x", size))); err != nil {
+		t.Fatalf("failed to append log: %s", err)
+	}
+}
+
+func TestJanitorPurge(t *testing.T) {
+	now := time.Now()
+
+	testcases := []struct {
+		name   string
+		policy *RetentionPolicy
+		purged []string
+	}{
+		{
+			name:   "empty policy",
+			policy: &RetentionPolicy{},
+			purged: []string{},
+		},
+		{
+			name:   "max age",
+			policy: &RetentionPolicy{MaxAge: 1800},
+			purged: []string{"failed-old", "success-old"},
+		},
+		{
+			name:   "max age of failed",
+			policy: &RetentionPolicy{MaxAge: 1800, MaxAgeFailed: 3 * 3600},
+			purged: []string{"success-old"},
+		},
+		{
+			name:   "max jobs keeps the latest",
+			policy: &RetentionPolicy{MaxJobs: 2},
+			purged: []string{"failed-old", "success-old"},
+		},
+		{
+			name:   "max bytes keeps the latest",
+			policy: &RetentionPolicy{MaxBytes: 250},
+			purged: []string{"failed-old", "success-old"},
+		},
+	}
+
+	for _, tc := range testcases {
+		for name, store := range newTestJobStores(t) {
+			t.Run(fmt.Sprintf("%s/%s", tc.name, name), func(t *testing.T) {
+				createTestFinishedJob(t, store, "success-new", entities.JobStatusSuccess, now.Add(-time.Minute), 100)
+				createTestFinishedJob(t, store, "failed-new", entities.JobStatusFailure, now.Add(-2*time.Minute), 100)
+				createTestFinishedJob(t, store, "success-old", entities.JobStatusSuccess, now.Add(-time.Hour), 100)
+				createTestFinishedJob(t, store, "failed-old", entities.JobStatusFailure, now.Add(-2*time.Hour), 100)
+				// the running job is never purged
+				createTestFinishedJob(t, store, "running", entities.JobStatusRunning, time.Time{}, 1000)
+
+				cfg := &Config{WorkDir: t.TempDir()}
+				result, err := NewJanitor(cfg, NewJobManager(cfg, store, nil, nil)).Purge(tc.policy)
+				if err != nil {
+					t.Fatalf("failed to purge: %s", err)
+				}
+
+				sort.Strings(result.IDs)
+				if strings.Join(result.IDs, ",") != strings.Join(tc.purged, ",") {
+					t.Fatalf("expected purged %v, got %v", tc.purged, result.IDs)
+				}
+				if result.Bytes != int64(100*len(tc.purged)) {
+					t.Fatalf("expected purged %d bytes, got %d", 100*len(tc.purged), result.Bytes)
+				}
+
+				for _, id := range []string{"success-new", "failed-new", "success-old", "failed-old", "running"} {
+					_, err := store.Get(id)
+					isPurged := strings.Contains(strings.Join(tc.purged, ","), id)
+					if isPurged != (err == ErrJobNotFound) {
+						t.Fatalf("expected job(%s) purged %v, got %v", id, isPurged, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestJanitorPurgeWorkDir(t *testing.T) {
+	cfg := &Config{WorkDir: t.TempDir()}
+	store := newFileSystemStore(t.TempDir())
+	createTestFinishedJob(t, store, "job-1", entities.JobStatusSuccess, time.Now().Add(-time.Hour), 10)
+
+	workDir := fmt.Sprintf("%s/job-1", cfg.WorkDir)
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fmt.Sprintf("%s/output", workDir), make([]byte, 90), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := NewJanitor(cfg, NewJobManager(cfg, store, nil, nil)).Purge(&RetentionPolicy{MaxAge: 60})
+	if err != nil {
+		t.Fatalf("failed to purge: %s", err)
+	}
+
+	// the size of workdir is counted
+	if result.Bytes != 100 {
+		t.Fatalf("expected purged 100 bytes, got %d", result.Bytes)
+	}
+	if _, err := os.Stat(workDir); !os.IsNotExist(err) {
+		t.Fatalf("expected workdir removed, got %v", err)
+	}
+}
+
+func TestJanitorPurgeAttempts(t *testing.T) {
+	cfg := &Config{WorkDir: t.TempDir()}
+	store := newFileSystemStore(t.TempDir())
+
+	finishedAt := time.Now().Add(-time.Hour)
+	if err := store.Create(&entities.Job{ID: "job-1", Attempt: 2, Status: entities.JobStatusSuccess, FinishedAt: &finishedAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the workdirs of all attempts are purged
+	for attempt := 1; attempt <= 2; attempt++ {
+		if err := os.MkdirAll(cfg.GetWorkDir("job-1", attempt), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fmt.Sprintf("%s/output", cfg.GetWorkDir("job-1", attempt)), make([]byte, 50), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := NewJanitor(cfg, NewJobManager(cfg, store, nil, nil)).Purge(&RetentionPolicy{MaxAge: 60})
+	if err != nil {
+		t.Fatalf("failed to purge: %s", err)
+	}
+	if result.Bytes != 100 {
+		t.Fatalf("expected purged 100 bytes, got %d", result.Bytes)
+	}
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		if _, err := os.Stat(cfg.GetWorkDir("job-1", attempt)); !os.IsNotExist(err) {
+			t.Fatalf("expected workdir of attempt %d removed, got %v", attempt, err)
+		}
+	}
+}
+
+func TestJanitorPurgeCustomWorkDir(t *testing.T) {
+	for name, store := range newTestJobStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{WorkDir: t.TempDir()}
+			base := t.TempDir()
+
+			// the workdirs under the custom workdir base are recorded by each attempt
+			finishedAt := time.Now().Add(-time.Hour)
+			workDirs := []string{}
+			for attempt := 1; attempt <= 2; attempt++ {
+				workDir := fmt.Sprintf("%s/%s", base, getAttemptDirName("job-1", attempt))
+				job := &entities.Job{ID: "job-1", Attempt: attempt, WorkDir: workDir, Status: entities.JobStatusSuccess, FinishedAt: &finishedAt}
+				if err := store.Create(job); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.MkdirAll(workDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(fmt.Sprintf("%s/output", workDir), make([]byte, 50), 0644); err != nil {
+					t.Fatal(err)
+				}
+				workDirs = append(workDirs, workDir)
+			}
+
+			result, err := NewJanitor(cfg, NewJobManager(cfg, store, nil, nil)).Purge(&RetentionPolicy{MaxAge: 60})
+			if err != nil {
+				t.Fatalf("failed to purge: %s", err)
+			}
+			if result.Bytes != 100 {
+				t.Fatalf("expected purged 100 bytes, got %d", result.Bytes)
+			}
+
+			for _, workDir := range workDirs {
+				if _, err := os.Stat(workDir); !os.IsNotExist(err) {
+					t.Fatalf("expected workdir %s removed, got %v", workDir, err)
+				}
+			}
+		})
+	}
+}
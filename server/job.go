@@ -0,0 +1,387 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-zoox/command"
+	"github.com/go-zoox/command/terminal"
+	"github.com/go-zoox/commands-as-a-service/entities"
+	"github.com/go-zoox/logger"
+)
+
+// ErrJobCancelled is returned when the job is cancelled before start
+var ErrJobCancelled = fmt.Errorf("job is cancelled")
+
+// ErrStdinFull is returned when the pending stdin of job is full, as the command does not read it
+var ErrStdinFull = fmt.Errorf("stdin is full, the input is dropped")
+
+// Job is a command running in a stream of the connection
+type Job struct {
+	ID       string
+	ClientID string
+	Identity *Identity
+	Stream   string
+	RunnerID string
+	CommandN *entities.Command
+	//
+	// cmd is set before start, started is set after the process is started, and stopped is set by Finish
+	cmdMu   sync.Mutex
+	cmd     command.Command
+	started bool
+	stopped bool
+	// killedByClose is set when the connection of job is closed
+	killedByClose atomic.Bool
+	//
+	cancelled   atomic.Bool
+	cancelOnce  sync.Once
+	cancelCh    chan struct{}
+	queued      atomic.Bool
+	interrupted atomic.Bool
+	//
+	stdinMu     sync.Mutex
+	stdinClosed bool
+	stdinCh     chan []byte
+	stdinReader *io.PipeReader
+	stdinWriter *io.PipeWriter
+	//
+	terminalMu   sync.Mutex
+	terminal     terminal.Terminal
+	terminalRows int
+	terminalCols int
+	//
+	outputMu sync.Mutex
+	log      *jobLog
+	// stdoutBytes and stderrBytes are the bytes of output by stream
+	stdoutBytes int64
+	stderrBytes int64
+	viewers     []*queuedViewer
+	done        chan struct{}
+	exit        *entities.Exit
+}
+
+// NewJob creates a job for the stream.
+func NewJob(stream string) *Job {
+	job := &Job{
+		Stream:   stream,
+		stdinCh:  make(chan []byte, 64),
+		cancelCh: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	job.stdinReader, job.stdinWriter = io.Pipe()
+
+	// write stdin in background, so that a command which does not read stdin
+	// will not block other streams in the same connection.
+	// the stdin is closed (EOF) after the pending stdin is written.
+	go func() {
+		for p := range job.stdinCh {
+			if _, err := job.stdinWriter.Write(p); err != nil {
+				logger.Debugf("[job][stream: %s] failed to write stdin: %s", stream, err)
+			}
+		}
+
+		job.stdinWriter.Close()
+	}()
+
+	return job
+}
+
+// Stdin returns the reader of stdin.
+func (j *Job) Stdin() io.Reader {
+	return j.stdinReader
+}
+
+// WriteStdin writes the stdin of the command in order, which never blocks.
+// The stdin is dropped with ErrStdinFull if the command does not read the pending stdin.
+func (j *Job) WriteStdin(p []byte) error {
+	j.stdinMu.Lock()
+	defer j.stdinMu.Unlock()
+
+	if j.stdinClosed || len(p) == 0 {
+		return nil
+	}
+
+	select {
+	case j.stdinCh <- p:
+		return nil
+	default:
+		return ErrStdinFull
+	}
+}
+
+// CloseStdin closes the stdin of the command, which means EOF after the pending stdin.
+func (j *Job) CloseStdin() {
+	j.stdinMu.Lock()
+	defer j.stdinMu.Unlock()
+
+	if !j.stdinClosed {
+		j.stdinClosed = true
+		close(j.stdinCh)
+	}
+}
+
+// Finish releases the resources of the job.
+func (j *Job) Finish() {
+	j.cmdMu.Lock()
+	j.stopped = true
+	j.cmdMu.Unlock()
+
+	// close reader first, so that the pending stdin fails fast
+	j.stdinReader.CloseWithError(io.ErrClosedPipe)
+
+	j.CloseStdin()
+}
+
+// Cancel cancels the running job, the exit reason is killed.
+// The job waiting in queue is removed from queue, and the job which is not started yet
+// will not start, see SetCmd and Start.
+func (j *Job) Cancel() error {
+	j.cancelled.Store(true)
+	j.cancelOnce.Do(func() {
+		close(j.cancelCh)
+	})
+
+	return j.kill()
+}
+
+// KillByClose cancels the job as the connection of job is closed.
+func (j *Job) KillByClose() error {
+	j.killedByClose.Store(true)
+	return j.Cancel()
+}
+
+// IsKilledByClose returns whether the job is cancelled by KillByClose.
+func (j *Job) IsKilledByClose() bool {
+	return j.killedByClose.Load()
+}
+
+// SetCmd sets the command of job before start, returns ErrJobCancelled if the job is cancelled.
+func (j *Job) SetCmd(cmd command.Command) error {
+	j.cmdMu.Lock()
+	defer j.cmdMu.Unlock()
+
+	if j.IsCancelled() {
+		return ErrJobCancelled
+	}
+
+	j.cmd = cmd
+	return nil
+}
+
+// Start marks the command as started after its process is started,
+// the command is killed if the job is cancelled before.
+func (j *Job) Start() {
+	j.cmdMu.Lock()
+	defer j.cmdMu.Unlock()
+
+	j.started = true
+	if j.IsCancelled() && !j.stopped {
+		j.cmd.Cancel()
+	}
+}
+
+// runningCmd returns the command if it is started and not stopped, otherwise nil.
+func (j *Job) runningCmd() command.Command {
+	j.cmdMu.Lock()
+	defer j.cmdMu.Unlock()
+
+	if j.cmd == nil || !j.started || j.stopped {
+		return nil
+	}
+
+	return j.cmd
+}
+
+// kill kills the running command, which does nothing if the command is not started or stopped.
+func (j *Job) kill() error {
+	if cmd := j.runningCmd(); cmd != nil {
+		return cmd.Cancel()
+	}
+
+	return nil
+}
+
+// IsCancelled returns whether the job is cancelled by Cancel.
+func (j *Job) IsCancelled() bool {
+	return j.cancelled.Load()
+}
+
+// Cancelled returns a channel which is closed when the job is cancelled.
+func (j *Job) Cancelled() <-chan struct{} {
+	return j.cancelCh
+}
+
+// Interrupt cancels the job by server shutdown, the exit reason is interrupted.
+func (j *Job) Interrupt() error {
+	j.interrupted.Store(true)
+	return j.Cancel()
+}
+
+// IsInterrupted returns whether the job is interrupted by Interrupt.
+func (j *Job) IsInterrupted() bool {
+	return j.interrupted.Load()
+}
+
+// IsQueued returns whether the job is waiting in queue.
+func (j *Job) IsQueued() bool {
+	return j.queued.Load()
+}
+
+// SetLog sets the log, which keeps the output of job by stream.
+func (j *Job) SetLog(log *jobLog) {
+	j.outputMu.Lock()
+	defer j.outputMu.Unlock()
+
+	j.log = log
+}
+
+// LogIndex returns the checkpoints of log being written, see jobLog.
+func (j *Job) LogIndex() []*entities.LogCheckpoint {
+	j.outputMu.Lock()
+	defer j.outputMu.Unlock()
+
+	if j.log == nil {
+		return nil
+	}
+
+	return j.log.Index()
+}
+
+// Output returns the writer of output, which writes to log and all the viewers.
+func (j *Job) Output(flag byte) io.Writer {
+	return &jobWriter{job: j, flag: flag}
+}
+
+// Subscribe adds the viewer of output and exit, returns the bytes of output in log before subscribed,
+// or false if the job is done.
+func (j *Job) Subscribe(viewer Viewer) (logSize int64, ok bool) {
+	j.outputMu.Lock()
+	defer j.outputMu.Unlock()
+
+	if j.exit != nil {
+		return 0, false
+	}
+
+	j.viewers = append(j.viewers, newQueuedViewer(viewer))
+	if j.log == nil {
+		return 0, true
+	}
+
+	return j.log.Size(), true
+}
+
+// Unsubscribe removes the viewer.
+func (j *Job) Unsubscribe(viewer Viewer) {
+	j.outputMu.Lock()
+	defer j.outputMu.Unlock()
+
+	for _, v := range j.viewers {
+		if v.viewer == viewer {
+			j.removeViewer(v, nil)
+			return
+		}
+	}
+}
+
+// removeViewer removes the viewer and stops it after its pending output, the exit is written at last if not nil.
+func (j *Job) removeViewer(viewer *queuedViewer, exit *entities.Exit) {
+	for i, v := range j.viewers {
+		if v == viewer {
+			j.viewers = append(j.viewers[:i], j.viewers[i+1:]...)
+			viewer.close(exit)
+			return
+		}
+	}
+}
+
+// Done sets the exit of job and notifies all the viewers, only the first exit is kept.
+// It waits for the viewers to write their pending output and exit, up to viewerDrainTimeout.
+func (j *Job) Done(exit *entities.Exit) {
+	j.outputMu.Lock()
+	if j.exit != nil {
+		j.outputMu.Unlock()
+		return
+	}
+
+	j.exit = exit
+	viewers := j.viewers
+	j.viewers = nil
+	for _, viewer := range viewers {
+		viewer.close(exit)
+	}
+	j.outputMu.Unlock()
+
+	// the viewers write without the lock of job, so that a slow viewer does not block others
+	for _, viewer := range viewers {
+		if !viewer.wait(viewerDrainTimeout) {
+			logger.Infof("[job][id: %s] viewer is too slow to write exit, skip it", j.ID)
+		}
+	}
+
+	close(j.done)
+}
+
+// OutputBytes returns the bytes of stdout and stderr.
+func (j *Job) OutputBytes() (stdout, stderr int64) {
+	j.outputMu.Lock()
+	defer j.outputMu.Unlock()
+
+	return j.stdoutBytes, j.stderrBytes
+}
+
+// Wait waits for the job to be done, and returns the exit.
+func (j *Job) Wait() *entities.Exit {
+	<-j.done
+	return j.exit
+}
+
+func (j *Job) write(flag byte, p []byte) {
+	j.outputMu.Lock()
+	defer j.outputMu.Unlock()
+
+	stream := entities.LogStreamStdout
+	if flag == entities.MessageCommandStderr {
+		stream = entities.LogStreamStderr
+		j.stderrBytes += int64(len(p))
+	} else {
+		j.stdoutBytes += int64(len(p))
+	}
+
+	if j.log != nil {
+		if err := j.log.Write(stream, p); err != nil {
+			logger.Errorf("[job][id: %s] failed to write log: %s", j.ID, err)
+		}
+	}
+
+	for _, viewer := range append([]*queuedViewer{}, j.viewers...) {
+		if viewer.push(flag, p) {
+			continue
+		}
+
+		// the broken viewer, like closed connection, and the viewer which falls behind will not block the job
+		if viewer.failed.Load() {
+			logger.Debugf("[job][id: %s] viewer is broken, remove it", j.ID)
+			j.removeViewer(viewer, nil)
+		} else {
+			logger.Infof("[job][id: %s] viewer falls behind the output, disconnect it", j.ID)
+			j.removeViewer(viewer, &entities.Exit{
+				Code:    -1,
+				Reason:  entities.ExitReasonDisconnected,
+				Message: "the viewer falls behind the output",
+			})
+		}
+	}
+}
+
+// jobWriter writes the output of job with flag
+type jobWriter struct {
+	job  *Job
+	flag byte
+}
+
+func (w *jobWriter) Write(p []byte) (n int, err error) {
+	w.job.write(w.flag, p)
+	return len(p), nil
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-zoox/command"
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+func TestJobWriteStdin(t *testing.T) {
+	job := NewJob("1")
+
+	// the command does not read stdin, which fills the pending stdin without blocking
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		err = job.WriteStdin([]byte("x"))
+	}
+	if err != ErrStdinFull {
+		t.Fatalf("expected %s, got %v", ErrStdinFull, err)
+	}
+
+	job.CloseStdin()
+	if err := job.WriteStdin([]byte("x")); err != nil {
+		t.Fatalf("expected the stdin after close is ignored, got %s", err)
+	}
+
+	// the pending stdin is read before EOF
+	content, err := io.ReadAll(job.Stdin())
+	if err != nil {
+		t.Fatalf("failed to read stdin: %s", err)
+	}
+	if len(content) == 0 {
+		t.Fatal("expected the pending stdin, got empty")
+	}
+}
+
+// testCommand records the cancel of command
+type testCommand struct {
+	command.Command
+	cancelled atomic.Int32
+}
+
+func (c *testCommand) Cancel() error {
+	c.cancelled.Add(1)
+	return nil
+}
+
+func TestJobCancelBeforeStart(t *testing.T) {
+	// cancelled before the command is set
+	job := NewJob("1")
+	if err := job.Cancel(); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if err := job.SetCmd(&testCommand{}); err != ErrJobCancelled {
+		t.Fatalf("expected %s, got %v", ErrJobCancelled, err)
+	}
+
+	// cancelled after the command is set, which is killed once started
+	job = NewJob("1")
+	cmd := &testCommand{}
+	if err := job.SetCmd(cmd); err != nil {
+		t.Fatalf("failed to set command: %s", err)
+	}
+	if err := job.Cancel(); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if n := cmd.cancelled.Load(); n != 0 {
+		t.Fatalf("expected the command not cancelled before start, got %d", n)
+	}
+	job.Start()
+	if n := cmd.cancelled.Load(); n != 1 {
+		t.Fatalf("expected the command cancelled by start, got %d", n)
+	}
+
+	// the stopped command is not cancelled
+	job.Finish()
+	job.Cancel()
+	if n := cmd.cancelled.Load(); n != 1 {
+		t.Fatalf("expected the stopped command not cancelled, got %d", n)
+	}
+}
+
+func TestJobKillByClose(t *testing.T) {
+	job := NewJob("1")
+	cmd := &testCommand{}
+	job.SetCmd(cmd)
+	job.Start()
+
+	job.KillByClose()
+	if !job.IsKilledByClose() || !job.IsCancelled() || cmd.cancelled.Load() != 1 {
+		t.Fatalf("expected the running command killed by close, got %d", cmd.cancelled.Load())
+	}
+}
+
+// blockingViewer blocks the output until released
+type blockingViewer struct {
+	testViewer
+	release chan struct{}
+}
+
+func (v *blockingViewer) WriteOutput(flag byte, p []byte) error {
+	<-v.release
+	return v.testViewer.WriteOutput(flag, p)
+}
+
+func TestJobSlowViewer(t *testing.T) {
+	job := NewJob("1")
+	job.ID = "job-1"
+
+	slow := &blockingViewer{release: make(chan struct{})}
+	fast := &testViewer{}
+	job.Subscribe(slow)
+	job.Subscribe(fast)
+
+	// the slow viewer does not block the output of job
+	output := job.Output(entities.MessageCommandStdout)
+	for i := 0; i < viewerQueueSize+2; i++ {
+		output.Write([]byte("x"))
+
+		// the fast viewer keeps up with the output
+		deadline := time.Now().Add(time.Second)
+		for len(fast.Output()) != i+1 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(slow.release)
+
+	job.Done(&entities.Exit{Code: 0, Reason: entities.ExitReasonExited})
+
+	if exit := fast.Exit(); exit == nil || exit.Reason != entities.ExitReasonExited {
+		t.Fatalf("expected the exit of job, got %+v", exit)
+	}
+	if n := len(fast.Output()); n != viewerQueueSize+2 {
+		t.Fatalf("expected all output of fast viewer, got %d", n)
+	}
+
+	// the slow viewer is disconnected after its pending output
+	deadline := time.Now().Add(time.Second)
+	for slow.Exit() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if exit := slow.Exit(); exit == nil || exit.Reason != entities.ExitReasonDisconnected {
+		t.Fatalf("expected the slow viewer disconnected, got %+v", exit)
+	}
+	if n := len(slow.Output()); n > viewerQueueSize+1 {
+		t.Fatalf("expected the output of slow viewer is limited by queue, got %d", n)
+	}
+}
+
+// brokenViewer fails to write
+type brokenViewer struct {
+	testViewer
+}
+
+func (v *brokenViewer) WriteOutput(flag byte, p []byte) error {
+	return io.ErrClosedPipe
+}
+
+func TestJobBrokenViewer(t *testing.T) {
+	job := NewJob("1")
+	broken := &brokenViewer{}
+	job.Subscribe(broken)
+
+	output := job.Output(entities.MessageCommandStdout)
+	output.Write([]byte("x"))
+
+	// the viewer is removed by the next write after it fails
+	deadline := time.Now().Add(time.Second)
+	for !job.viewers[0].failed.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	output.Write([]byte("x"))
+
+	job.outputMu.Lock()
+	n := len(job.viewers)
+	job.outputMu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected the broken viewer removed, got %d viewers", n)
+	}
+
+	job.Done(&entities.Exit{Code: 0, Reason: entities.ExitReasonExited})
+	if exit := broken.Exit(); exit != nil {
+		t.Fatalf("expected no exit to the broken viewer, got %+v", exit)
+	}
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the allowed clock skew when verifying exp and nbf
+const jwtLeeway = 60 * time.Second
+
+// jwtMinRSAKeySize is the min bits of RSA key
+const jwtMinRSAKeySize = 2048
+
+// jwtVerifier verifies the jwt of HS256 with secret, or RS256 and ES256 with the keys of jwks file.
+// The go-zoox/jwt only supports HMAC algorithms with one secret, so the jwt is verified here for the keys of jwks.
+// The algorithm of token must match its key: HS256 only uses the secret, and RS256 or ES256 only the keys of jwks.
+type jwtVerifier struct {
+	secret   []byte
+	keys     []*jwk
+	audience string
+	issuer   string
+}
+
+// jwk is the json web key, only RSA and EC (P-256) are supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	//
+	publicKey crypto.PublicKey
+}
+
+// jwtHeader is the header of jwt
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func newJWTVerifier(cfg *Config) (*jwtVerifier, error) {
+	verifier := &jwtVerifier{
+		secret:   []byte(cfg.JWTSecret),
+		audience: cfg.JWTAudience,
+		issuer:   cfg.JWTIssuer,
+	}
+
+	if cfg.JWTJWKSFile != "" {
+		content, err := os.ReadFile(cfg.JWTJWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read jwks file: %s", err)
+		}
+
+		jwks := &struct {
+			Keys []*jwk `json:"keys"`
+		}{}
+		if err := json.Unmarshal(content, jwks); err != nil {
+			return nil, fmt.Errorf("failed to decode jwks file: %s", err)
+		}
+
+		for _, key := range jwks.Keys {
+			if key.Use != "" && key.Use != "sig" {
+				continue
+			}
+
+			if err := key.parse(); err != nil {
+				return nil, fmt.Errorf("failed to parse jwk(%s): %s", key.Kid, err)
+			}
+
+			verifier.keys = append(verifier.keys, key)
+		}
+	}
+
+	return verifier, nil
+}
+
+// Verify verifies the signature, expiry, audience and issuer of token, returns the identity of claims.
+func (v *jwtVerifier) Verify(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	header := &jwtHeader{}
+	if err := decodeJWTPart(parts[0], header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %s", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %s", err)
+	}
+
+	if err := v.verifySignature(header, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]any{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %s", err)
+	}
+
+	if err := v.verifyClaims(claims); err != nil {
+		return nil, err
+	}
+
+	// the empty client id would share the jobs of other tokens without client
+	identity := newJWTIdentity(claims)
+	if identity.ClientID == "" {
+		return nil, fmt.Errorf("token has no sub or client_id")
+	}
+
+	return identity, nil
+}
+
+func (v *jwtVerifier) verifySignature(header *jwtHeader, signed string, signature []byte) error {
+	hash := sha256.Sum256([]byte(signed))
+
+	switch header.Alg {
+	case "HS256":
+		if len(v.secret) == 0 {
+			return fmt.Errorf("unsupported token algorithm: %s", header.Alg)
+		}
+
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return fmt.Errorf("invalid token signature")
+		}
+
+		return nil
+	case "RS256", "ES256":
+		for _, key := range v.keys {
+			if header.Kid != "" && key.Kid != header.Kid {
+				continue
+			}
+			if key.Alg != "" && key.Alg != header.Alg {
+				continue
+			}
+
+			switch publicKey := key.publicKey.(type) {
+			case *rsa.PublicKey:
+				if header.Alg == "RS256" && rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature) == nil {
+					return nil
+				}
+			case *ecdsa.PublicKey:
+				// the signature of ES256 is r and s in 32 bytes each
+				if header.Alg == "ES256" && len(signature) == 64 {
+					r := new(big.Int).SetBytes(signature[:32])
+					s := new(big.Int).SetBytes(signature[32:])
+					if ecdsa.Verify(publicKey, hash[:], r, s) {
+						return nil
+					}
+				}
+			}
+		}
+
+		return fmt.Errorf("invalid token signature")
+	default:
+		return fmt.Errorf("unsupported token algorithm: %s", header.Alg)
+	}
+}
+
+// verifyClaims verifies the claims, the exp and nbf allow the clock skew of jwtLeeway.
+func (v *jwtVerifier) verifyClaims(claims map[string]any) error {
+	now := time.Now().Unix()
+	leeway := int64(jwtLeeway.Seconds())
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now >= int64(exp)+leeway {
+		return fmt.Errorf("token is expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now+leeway < int64(nbf) {
+		return fmt.Errorf("token is not valid yet")
+	}
+
+	if v.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.issuer {
+			return fmt.Errorf("invalid token issuer: %s", iss)
+		}
+	}
+
+	if v.audience != "" {
+		isMatched := false
+		for _, aud := range getClaimStrings(claims, "aud") {
+			if aud == v.audience {
+				isMatched = true
+				break
+			}
+		}
+
+		if !isMatched {
+			return fmt.Errorf("invalid token audience")
+		}
+	}
+
+	return nil
+}
+
+func (k *jwk) parse() error {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("invalid n: %s", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return fmt.Errorf("invalid e: %s", err)
+		}
+
+		// the exponent over 31 bits is rejected, which overflows int of rsa
+		exponent := new(big.Int).SetBytes(e)
+		if exponent.BitLen() > 31 {
+			return fmt.Errorf("invalid e: %s", exponent)
+		}
+
+		publicKey := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(exponent.Int64()),
+		}
+		if publicKey.N.BitLen() < jwtMinRSAKeySize {
+			return fmt.Errorf("rsa key size %d is less than %d", publicKey.N.BitLen(), jwtMinRSAKeySize)
+		}
+		if publicKey.E < 3 || publicKey.E%2 == 0 {
+			return fmt.Errorf("invalid e: %d", publicKey.E)
+		}
+
+		k.publicKey = publicKey
+		return nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return fmt.Errorf("invalid x: %s", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return fmt.Errorf("invalid y: %s", err)
+		}
+
+		publicKey := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return fmt.Errorf("invalid point")
+		}
+
+		k.publicKey = publicKey
+		return nil
+	default:
+		return fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+}
+
+// newJWTIdentity returns the identity of claims, the client id is client_id or sub,
+// the scopes are scope (separated by space), scopes or scp, and the roles are roles.
+func newJWTIdentity(claims map[string]any) *Identity {
+	identity := &Identity{
+		Claims: claims,
+		Scopes: []string{},
+	}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.ClientID = identity.Subject
+	if clientID, ok := claims["client_id"].(string); ok && clientID != "" {
+		identity.ClientID = clientID
+	}
+
+	if scope, ok := claims["scope"].(string); ok {
+		identity.Scopes = append(identity.Scopes, strings.Fields(scope)...)
+	}
+	identity.Scopes = append(identity.Scopes, getClaimStrings(claims, "scopes")...)
+	identity.Scopes = append(identity.Scopes, getClaimStrings(claims, "scp")...)
+	identity.Roles = getClaimStrings(claims, "roles")
+
+	return identity
+}
+
+// getClaimStrings returns the claim of string or string array.
+func getClaimStrings(claims map[string]any, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []any:
+		values := []string{}
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func decodeJWTPart(part string, v any) error {
+	content, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, v)
+}
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type jwtTestKeys struct {
+	rsa      *rsa.PrivateKey
+	ec       *ecdsa.PrivateKey
+	jwksFile string
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := map[string]any{
+		"keys": []map[string]any{
+			{
+				"kty": "RSA",
+				"kid": "rsa-1",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   encodeJWTTestBytes(rsaKey.N.Bytes()),
+				"e":   encodeJWTTestBytes(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec-1",
+				"use": "sig",
+				"alg": "ES256",
+				"crv": "P-256",
+				"x":   encodeJWTTestBytes(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   encodeJWTTestBytes(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	}
+
+	content, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &jwtTestKeys{rsa: rsaKey, ec: ecKey, jwksFile: jwksFile}
+}
+
+// sign signs the claims with alg, the secret is used by HS256.
+func (k *jwtTestKeys) sign(t *testing.T, alg, kid string, secret string, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]any{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := encodeJWTTestBytes(header) + "." + encodeJWTTestBytes(payload)
+	hash := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "RS256":
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, hash[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signed + "." + encodeJWTTestBytes(signature)
+}
+
+func encodeJWTTestBytes(p []byte) string {
+	return base64.RawURLEncoding.EncodeToString(p)
+}
+
+func TestJWTVerifier(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	now := time.Now().Unix()
+
+	claims := func(override map[string]any) map[string]any {
+		c := map[string]any{
+			"sub": "user-1",
+			"iss": "https://issuer.example",
+			"aud": "caas",
+			"exp": now + 3600,
+		}
+		for k, v := range override {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	hsConfig := &Config{JWTSecret: "secret", JWTIssuer: "https://issuer.example", JWTAudience: "caas"}
+	jwksConfig := &Config{JWTJWKSFile: keys.jwksFile, JWTIssuer: "https://issuer.example", JWTAudience: "caas"}
+
+	testcases := []struct {
+		name  string
+		cfg   *Config
+		token string
+		err   string
+	}{
+		{
+			name:  "HS256",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "secret", claims(nil)),
+		},
+		{
+			name:  "RS256",
+			cfg:   jwksConfig,
+			token: keys.sign(t, "RS256", "rsa-1", "", claims(nil)),
+		},
+		{
+			name:  "ES256",
+			cfg:   jwksConfig,
+			token: keys.sign(t, "ES256", "ec-1", "", claims(nil)),
+		},
+		{
+			name:  "RS256 without kid",
+			cfg:   jwksConfig,
+			token: keys.sign(t, "RS256", "", "", claims(nil)),
+		},
+		{
+			name:  "HS256 with wrong secret",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "wrong", claims(nil)),
+			err:   "invalid token signature",
+		},
+		{
+			name:  "expired",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "secret", claims(map[string]any{"exp": now - 2*int64(jwtLeeway.Seconds())})),
+			err:   "token is expired",
+		},
+		{
+			name:  "expired within leeway",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "secret", claims(map[string]any{"exp": now - int64(jwtLeeway.Seconds())/2})),
+		},
+		{
+			name:  "no expiry",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "secret", claims(map[string]any{"exp": nil})),
+			err:   "token has no expiry",
+		},
+		{
+			name:  "not valid yet",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "secret", claims(map[string]any{"nbf": now + 2*int64(jwtLeeway.Seconds())})),
+			err:   "token is not valid yet",
+		},
+		{
+			name:  "not valid yet within leeway",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "secret", claims(map[string]any{"nbf": now + int64(jwtLeeway.Seconds())/2})),
+		},
+		{
+			name:  "wrong audience",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "secret", claims(map[string]any{"aud": "other"})),
+			err:   "invalid token audience",
+		},
+		{
+			name:  "audience in array",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "secret", claims(map[string]any{"aud": []string{"other", "caas"}})),
+		},
+		{
+			name:  "wrong issuer",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "secret", claims(map[string]any{"iss": "https://evil.example"})),
+			err:   "invalid token issuer",
+		},
+		{
+			name:  "alg none",
+			cfg:   hsConfig,
+			token: strings.TrimSuffix(keys.sign(t, "none", "", "", claims(nil)), ".") + ".",
+			err:   "unsupported token algorithm: none",
+		},
+		{
+			name:  "HS256 against jwks only",
+			cfg:   jwksConfig,
+			token: keys.sign(t, "HS256", "rsa-1", "", claims(nil)),
+			err:   "unsupported token algorithm: HS256",
+		},
+		{
+			name:  "wrong kid",
+			cfg:   jwksConfig,
+			token: keys.sign(t, "RS256", "unknown", "", claims(nil)),
+			err:   "invalid token signature",
+		},
+		{
+			name:  "kid of other alg",
+			cfg:   jwksConfig,
+			token: keys.sign(t, "RS256", "ec-1", "", claims(nil)),
+			err:   "invalid token signature",
+		},
+		{
+			name:  "HS256 signed by rsa public key",
+			cfg:   &Config{JWTSecret: "secret", JWTJWKSFile: keys.jwksFile},
+			token: keys.sign(t, "HS256", "rsa-1", string(x509.MarshalPKCS1PublicKey(&keys.rsa.PublicKey)), claims(nil)),
+			err:   "invalid token signature",
+		},
+		{
+			name:  "RS256 against secret only",
+			cfg:   hsConfig,
+			token: keys.sign(t, "RS256", "rsa-1", "", claims(nil)),
+			err:   "invalid token signature",
+		},
+		{
+			name:  "expiry is not number",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "secret", claims(map[string]any{"exp": fmt.Sprintf("%d", now+3600)})),
+			err:   "token has no expiry",
+		},
+		{
+			name:  "client id without sub",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "secret", claims(map[string]any{"sub": nil, "client_id": "user-1"})),
+		},
+		{
+			name:  "no sub or client id",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "secret", claims(map[string]any{"sub": nil})),
+			err:   "token has no sub or client_id",
+		},
+		{
+			name:  "empty sub",
+			cfg:   hsConfig,
+			token: keys.sign(t, "HS256", "", "secret", claims(map[string]any{"sub": ""})),
+			err:   "token has no sub or client_id",
+		},
+		{
+			name:  "malformed",
+			cfg:   hsConfig,
+			token: "not-a-token",
+			err:   "invalid token",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			verifier, err := newJWTVerifier(tc.cfg)
+			if err != nil {
+				t.Fatalf("failed to create verifier: %s", err)
+			}
+
+			identity, err := verifier.Verify(tc.token)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if identity.ClientID != "user-1" {
+				t.Fatalf("expected client id user-1, got %s", identity.ClientID)
+			}
+		})
+	}
+}
+
+func TestJWTVerifierRejectsSmallRSAKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := json.Marshal(map[string]any{
+		"keys": []map[string]any{
+			{
+				"kty": "RSA",
+				"kid": "small",
+				"n":   encodeJWTTestBytes(key.N.Bytes()),
+				"e":   encodeJWTTestBytes(big.NewInt(int64(key.E)).Bytes()),
+			},
+		},
+	})
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newJWTVerifier(&Config{JWTJWKSFile: jwksFile}); err == nil || !strings.Contains(err.Error(), "rsa key size") {
+		t.Fatalf("expected rsa key size error, got %v", err)
+	}
+}
+
+func TestJWTVerifierRejectsInvalidRSAExponent(t *testing.T) {
+	keys := newJWTTestKeys(t)
+
+	testcases := map[string][]byte{
+		// 2^64 + 3, which is 3 if truncated to int64
+		"overflow": new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), 64), big.NewInt(3)).Bytes(),
+		"even":     big.NewInt(65536).Bytes(),
+		"one":      big.NewInt(1).Bytes(),
+	}
+	for name, e := range testcases {
+		t.Run(name, func(t *testing.T) {
+			content, _ := json.Marshal(map[string]any{
+				"keys": []map[string]any{
+					{
+						"kty": "RSA",
+						"n":   encodeJWTTestBytes(keys.rsa.N.Bytes()),
+						"e":   encodeJWTTestBytes(e),
+					},
+				},
+			})
+			jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+			if err := os.WriteFile(jwksFile, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := newJWTVerifier(&Config{JWTJWKSFile: jwksFile}); err == nil || !strings.Contains(err.Error(), "invalid e") {
+				t.Fatalf("expected invalid e error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNewJWTIdentity(t *testing.T) {
+	identity := newJWTIdentity(map[string]any{
+		"sub":       "user-1",
+		"client_id": "client-1",
+		"scope":     "exec read",
+		"scp":       []any{"cancel"},
+		"roles":     []any{"admin"},
+	})
+
+	if identity.ClientID != "client-1" || identity.Subject != "user-1" {
+		t.Fatalf("unexpected client id %s or subject %s", identity.ClientID, identity.Subject)
+	}
+	if strings.Join(identity.Scopes, ",") != "exec,read,cancel" {
+		t.Fatalf("unexpected scopes: %v", identity.Scopes)
+	}
+	if !identity.IsAdmin() {
+		t.Fatal("expected admin by role")
+	}
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// logCheckpointInterval is the initial bytes of output between the checkpoints of log index
+const logCheckpointInterval = 1024 * 1024
+
+// maxLogCheckpoints is the max count of checkpoints, the interval is doubled when it is exceeded
+const maxLogCheckpoints = 64
+
+// jobLog writes the output of job to store as json lines, the output over maxSize bytes is dropped with truncation markers.
+//
+// The offset of log is the bytes of output, the markers are not counted.
+// The positions of output entries are indexed by checkpoints, so that the log is read from offset without scanning from start.
+type jobLog struct {
+	store   JobStore
+	id      string
+	maxSize int64
+	//
+	mu      sync.Mutex
+	size    int64
+	dropped int64
+	closed  bool
+	// position is the bytes of log written to store
+	position int64
+	index    []*entities.LogCheckpoint
+	interval int64
+}
+
+func newJobLog(store JobStore, id string, maxSize int64) *jobLog {
+	return &jobLog{
+		store:    store,
+		id:       id,
+		maxSize:  maxSize,
+		interval: logCheckpointInterval,
+	}
+}
+
+// Write writes the output of stream.
+func (l *jobLog) Write(stream string, p []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed || len(p) == 0 {
+		return nil
+	}
+
+	if l.maxSize > 0 && l.size+int64(len(p)) > l.maxSize {
+		if l.dropped == 0 {
+			// keep the head of output until max size
+			if head := l.maxSize - l.size; head > 0 {
+				if err := l.appendOutput(stream, p[:head]); err != nil {
+					return err
+				}
+				p = p[head:]
+			}
+
+			l.append(entities.NewLogEntry(entities.LogStreamMarker, []byte(fmt.Sprintf("[log truncated: exceeds max log size %d bytes]\n", l.maxSize))))
+		}
+
+		l.dropped += int64(len(p))
+		return nil
+	}
+
+	return l.appendOutput(stream, p)
+}
+
+// Size returns the bytes of output in log.
+func (l *jobLog) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.size
+}
+
+// Index returns the checkpoints of log.
+func (l *jobLog) Index() []*entities.LogCheckpoint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]*entities.LogCheckpoint{}, l.index...)
+}
+
+// Close writes the summary marker if the log is truncated, the later output is ignored.
+func (l *jobLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	if l.dropped != 0 {
+		return l.append(entities.NewLogEntry(entities.LogStreamMarker, []byte(fmt.Sprintf("[log truncated: %d bytes dropped]\n", l.dropped))))
+	}
+
+	return nil
+}
+
+// appendOutput appends the output entry, which is indexed if the output since last checkpoint exceeds the interval.
+func (l *jobLog) appendOutput(stream string, p []byte) error {
+	last := int64(0)
+	if n := len(l.index); n != 0 {
+		last = l.index[n-1].Offset
+	}
+
+	if l.size-last >= l.interval {
+		l.index = append(l.index, &entities.LogCheckpoint{Offset: l.size, Position: l.position})
+		if len(l.index) > maxLogCheckpoints {
+			index := []*entities.LogCheckpoint{}
+			for i := 1; i < len(l.index); i += 2 {
+				index = append(index, l.index[i])
+			}
+			l.index = index
+			l.interval *= 2
+		}
+	}
+
+	if err := l.append(entities.NewLogEntry(stream, p)); err != nil {
+		return err
+	}
+
+	l.size += int64(len(p))
+	return nil
+}
+
+func (l *jobLog) append(entry *entities.LogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+	if err := l.store.AppendLog(l.id, line); err != nil {
+		return err
+	}
+
+	l.position += int64(len(line))
+	return nil
+}
+
+// readLogEntries reads the log entries of job from offset until end (exclusive, -1 means all),
+// the data of output entries is cut by the range, the markers in range are kept.
+// The log is read by the format of record, from the last checkpoint before offset in its index.
+func readLogEntries(store JobStore, record *entities.Job, offset, end int64, fn func(entry *entities.LogEntry, data []byte) error) error {
+	checkpoint := seekLog(record, offset)
+	reader, err := store.ReadLog(record.ID, checkpoint.Position)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return scanLogEntries(reader, record.LogVersion, checkpoint.Offset, offset, end, fn)
+}
+
+// readAttemptLogEntries reads the log entries of archived attempt, see readLogEntries.
+func readAttemptLogEntries(store JobStore, record *entities.Job, attempt int, offset, end int64, fn func(entry *entities.LogEntry, data []byte) error) error {
+	checkpoint := seekLog(record, offset)
+	reader, err := store.ReadAttemptLog(record.ID, attempt, checkpoint.Position)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return scanLogEntries(reader, record.LogVersion, checkpoint.Offset, offset, end, fn)
+}
+
+// seekLog returns the position to read the log from offset, the raw output of legacy log is read from offset directly.
+func seekLog(record *entities.Job, offset int64) *entities.LogCheckpoint {
+	if record.LogVersion != entities.LogVersion {
+		return &entities.LogCheckpoint{Offset: offset, Position: offset}
+	}
+
+	// the markers at the offset of checkpoint may be before it, so that the checkpoint must be before offset
+	checkpoint := &entities.LogCheckpoint{}
+	for _, one := range record.LogIndex {
+		if one.Offset >= offset {
+			break
+		}
+		checkpoint = one
+	}
+
+	return checkpoint
+}
+
+// scanLogEntries scans the log whose output starts at position, see readLogEntries.
+func scanLogEntries(reader io.Reader, version int, position, offset, end int64, fn func(entry *entities.LogEntry, data []byte) error) error {
+	if version != entities.LogVersion {
+		return scanRawLog(reader, position, end, fn)
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for scanner.Scan() {
+		if end >= 0 && position >= end {
+			return nil
+		}
+
+		// the line broken by crash is skipped
+		entry := &entities.LogEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			continue
+		}
+
+		data := entry.Bytes()
+		if entry.Stream == entities.LogStreamMarker {
+			if position >= offset {
+				if err := fn(entry, data); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		start := position
+		position += int64(len(data))
+		if position <= offset {
+			continue
+		}
+
+		if start < offset {
+			data = data[offset-start:]
+			start = offset
+		}
+		if end >= 0 && position > end {
+			data = data[:end-start]
+		}
+
+		if err := fn(entry, data); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// scanRawLog scans the raw output of legacy log as stdout, which starts at position.
+func scanRawLog(reader io.Reader, position, end int64, fn func(entry *entities.LogEntry, data []byte) error) error {
+	buf := make([]byte, 32*1024)
+	for {
+		if end >= 0 && position >= end {
+			return nil
+		}
+
+		n, err := reader.Read(buf)
+		if n > 0 {
+			data := append([]byte{}, buf[:n]...)
+			if end >= 0 && position+int64(n) > end {
+				data = data[:end-position]
+			}
+			position += int64(n)
+
+			if err := fn(&entities.LogEntry{Stream: entities.LogStreamStdout, Data: string(data)}, data); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
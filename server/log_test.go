@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+func newTestLogStore(t *testing.T, id string) JobStore {
+	t.Helper()
+
+	store := newFileSystemStore(t.TempDir())
+	if err := store.Create(&entities.Job{ID: id, LogVersion: entities.LogVersion}); err != nil {
+		t.Fatalf("failed to create job: %s", err)
+	}
+
+	return store
+}
+
+// readTestLog reads the output and markers of log in range.
+func readTestLog(t *testing.T, store JobStore, record *entities.Job, offset, end int64) (string, []string) {
+	t.Helper()
+
+	output := &bytes.Buffer{}
+	markers := []string{}
+	err := readLogEntries(store, record, offset, end, func(entry *entities.LogEntry, data []byte) error {
+		if entry.Stream == entities.LogStreamMarker {
+			markers = append(markers, string(data))
+			return nil
+		}
+
+		output.Write(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read log: %s", err)
+	}
+
+	return output.String(), markers
+}
+
+func TestJobLogTruncation(t *testing.T) {
+	store := newTestLogStore(t, "job-1")
+	record := &entities.Job{ID: "job-1", LogVersion: entities.LogVersion}
+	log := newJobLog(store, "job-1", 10)
+
+	log.Write(entities.LogStreamStdout, []byte("hello "))
+	log.Write(entities.LogStreamStderr, []byte("world!\n"))
+	log.Write(entities.LogStreamStdout, []byte("more"))
+	if err := log.Close(); err != nil {
+		t.Fatalf("failed to close log: %s", err)
+	}
+
+	// the output after close is ignored
+	log.Write(entities.LogStreamStdout, []byte("ignored"))
+
+	if log.Size() != 10 {
+		t.Fatalf("expected size 10, got %d", log.Size())
+	}
+
+	output, markers := readTestLog(t, store, record, 0, -1)
+	if output != "hello worl" {
+		t.Fatalf("expected the head of output, got %q", output)
+	}
+	if len(markers) != 2 {
+		t.Fatalf("expected 2 markers, got %q", markers)
+	}
+	if !strings.Contains(markers[0], "exceeds max log size 10 bytes") {
+		t.Fatalf("unexpected truncation marker: %q", markers[0])
+	}
+	if !strings.Contains(markers[1], "7 bytes dropped") {
+		t.Fatalf("unexpected summary marker: %q", markers[1])
+	}
+}
+
+func TestJobLogUnlimited(t *testing.T) {
+	store := newTestLogStore(t, "job-1")
+	record := &entities.Job{ID: "job-1", LogVersion: entities.LogVersion}
+	log := newJobLog(store, "job-1", 0)
+
+	log.Write(entities.LogStreamStdout, []byte("hello "))
+	log.Write(entities.LogStreamStdout, []byte{0xff, 0xfe})
+	log.Close()
+
+	if log.Size() != 8 {
+		t.Fatalf("expected size 8, got %d", log.Size())
+	}
+
+	output, markers := readTestLog(t, store, record, 0, -1)
+	if output != "hello \xff\xfe" || len(markers) != 0 {
+		t.Fatalf("unexpected output %q or markers %q", output, markers)
+	}
+}
+
+func TestReadLogEntriesRange(t *testing.T) {
+	store := newTestLogStore(t, "job-1")
+	record := &entities.Job{ID: "job-1", LogVersion: entities.LogVersion}
+	log := newJobLog(store, "job-1", 10)
+	log.Write(entities.LogStreamStdout, []byte("hello "))
+	log.Write(entities.LogStreamStdout, []byte("world!\n"))
+	log.Close()
+
+	testcases := []struct {
+		name    string
+		offset  int64
+		end     int64
+		output  string
+		markers int
+	}{
+		{"all", 0, -1, "hello worl", 2},
+		{"from offset", 3, -1, "lo worl", 2},
+		{"offset at entry boundary", 6, -1, "worl", 2},
+		{"until end", 0, 8, "hello wo", 0},
+		{"in one entry", 1, 4, "ell", 0},
+		{"across entries", 3, 8, "lo wo", 0},
+		// the offset stops at max size, only the markers are left
+		{"from max size", 10, -1, "", 2},
+		{"past max size", 20, -1, "", 0},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, markers := readTestLog(t, store, record, tc.offset, tc.end)
+			if output != tc.output {
+				t.Fatalf("expected output %q, got %q", tc.output, output)
+			}
+			if len(markers) != tc.markers {
+				t.Fatalf("expected %d markers, got %q", tc.markers, markers)
+			}
+		})
+	}
+}
+
+func TestReadLogEntriesCompressed(t *testing.T) {
+	store := newTestLogStore(t, "job-1")
+	record := &entities.Job{ID: "job-1", LogVersion: entities.LogVersion}
+	log := newJobLog(store, "job-1", 0)
+	log.Write(entities.LogStreamStdout, []byte("hello "))
+	log.Write(entities.LogStreamStderr, []byte("world\n"))
+	log.Close()
+
+	if err := store.CloseLog("job-1", true); err != nil {
+		t.Fatalf("failed to close log: %s", err)
+	}
+
+	output, _ := readTestLog(t, store, record, 3, -1)
+	if output != "lo world\n" {
+		t.Fatalf("expected output from offset, got %q", output)
+	}
+}
+
+func TestReadLogEntriesLegacy(t *testing.T) {
+	store := newTestLogStore(t, "job-1")
+
+	// the legacy log is the raw output, even if the line is a log entry
+	content := "plain\n{not json\n" + `{"stream":"stdout","data":"x"}` + "\nno newline"
+	if err := store.AppendLog("job-1", []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	record := &entities.Job{ID: "job-1"}
+	testcases := []struct {
+		name   string
+		offset int64
+		end    int64
+		output string
+	}{
+		{"all", 0, -1, content},
+		{"from offset", 6, -1, content[6:]},
+		{"in range", 6, 16, content[6:16]},
+		{"past end", 100, -1, ""},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, markers := readTestLog(t, store, record, tc.offset, tc.end)
+			if output != tc.output || len(markers) != 0 {
+				t.Fatalf("expected output %q, got %q %q", tc.output, output, markers)
+			}
+		})
+	}
+
+	err := readLogEntries(store, record, 0, -1, func(entry *entities.LogEntry, data []byte) error {
+		if entry.Stream != entities.LogStreamStdout {
+			t.Fatalf("expected legacy stdout, got %s", entry.Stream)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read log: %s", err)
+	}
+}
+
+// seekTestStore records the position of reading log.
+type seekTestStore struct {
+	JobStore
+	positions []int64
+}
+
+func (s *seekTestStore) ReadLog(id string, offset int64) (io.ReadCloser, error) {
+	s.positions = append(s.positions, offset)
+	return s.JobStore.ReadLog(id, offset)
+}
+
+func TestReadLogEntriesSeek(t *testing.T) {
+	store := &seekTestStore{JobStore: newTestLogStore(t, "job-1")}
+	log := newJobLog(store, "job-1", 0)
+	log.interval = 4
+
+	expected := ""
+	for i := 0; i < 20; i++ {
+		p := fmt.Sprintf("line %d\n", i)
+		log.Write(entities.LogStreamStdout, []byte(p))
+		expected += p
+	}
+	log.Close()
+
+	index := log.Index()
+	if len(index) == 0 {
+		t.Fatal("expected the log is indexed")
+	}
+
+	record := &entities.Job{ID: "job-1", LogVersion: entities.LogVersion, LogIndex: index}
+	for offset := int64(0); offset <= int64(len(expected)); offset++ {
+		store.positions = nil
+		if output, _ := readTestLog(t, store, record, offset, -1); output != expected[offset:] {
+			t.Fatalf("expected output %q from offset %d, got %q", expected[offset:], offset, output)
+		}
+
+		if checkpoint := seekLog(record, offset); store.positions[0] != checkpoint.Position || (offset > index[0].Offset && checkpoint.Position == 0) {
+			t.Fatalf("expected the log is read from checkpoint %+v at offset %d, got %v", checkpoint, offset, store.positions)
+		}
+	}
+}
+
+func TestJobLogIndexLimit(t *testing.T) {
+	store := newTestLogStore(t, "job-1")
+	log := newJobLog(store, "job-1", 0)
+	log.interval = 1
+
+	for i := 0; i < 10*maxLogCheckpoints; i++ {
+		log.Write(entities.LogStreamStdout, []byte("x"))
+	}
+
+	index := log.Index()
+	if len(index) > maxLogCheckpoints {
+		t.Fatalf("expected at most %d checkpoints, got %d", maxLogCheckpoints, len(index))
+	}
+	for i := 1; i < len(index); i++ {
+		if index[i].Offset <= index[i-1].Offset || index[i].Position <= index[i-1].Position {
+			t.Fatalf("expected the checkpoints in order, got %+v after %+v", index[i], index[i-1])
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// JobManager manages the running jobs of server by id
+type JobManager struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	closed  bool
+	changed chan struct{}
+	//
+	queue  *Queue
+	quota  *Quota
+	store  JobStore
+	policy *Policy
+	//
+	commands *CommandRegistry
+}
+
+// NewJobManager creates a job manager with the queue and quota of config, the store of job,
+// the policy of client and the registry of commands.
+func NewJobManager(cfg *Config, store JobStore, policy *Policy, commands *CommandRegistry) *JobManager {
+	return &JobManager{
+		jobs:    map[string]*Job{},
+		changed: make(chan struct{}),
+		queue:   NewQueue(int(cfg.MaxConcurrentJobs)),
+		quota:   NewQuota(cfg),
+		store:   store,
+		policy:  policy,
+		//
+		commands: commands,
+	}
+}
+
+// Store returns the store of job metadata and log.
+func (m *JobManager) Store() JobStore {
+	return m.store
+}
+
+// Quota returns the per client quota.
+func (m *JobManager) Quota() *Quota {
+	return m.quota
+}
+
+// Policy returns the policy of client, nil means all allowed.
+func (m *JobManager) Policy() *Policy {
+	return m.policy
+}
+
+// Commands returns the registry of command templates and script rules.
+func (m *JobManager) Commands() *CommandRegistry {
+	return m.commands
+}
+
+// Acquire waits in queue until the job is allowed to run or cancelled.
+func (m *JobManager) Acquire(job *Job, timeout time.Duration, onPosition func(position int)) error {
+	job.queued.Store(true)
+	defer job.queued.Store(false)
+
+	return m.queue.Acquire(job.Cancelled(), timeout, onPosition)
+}
+
+// Release releases the running slot of job.
+func (m *JobManager) Release() {
+	m.queue.Release()
+}
+
+// Add adds the running job, returns false if a job with the same id is running.
+func (m *JobManager) Add(job *Job) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.jobs[job.ID]; ok {
+		return false
+	}
+
+	m.jobs[job.ID] = job
+	return true
+}
+
+// Close stops accepting new jobs.
+func (m *JobManager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+}
+
+// IsClosed returns whether the manager stops accepting new jobs.
+func (m *JobManager) IsClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.closed
+}
+
+// Wait waits until there is no running job, or returns error when ctx is done.
+func (m *JobManager) Wait(ctx context.Context) error {
+	for {
+		m.mu.Lock()
+		count := len(m.jobs)
+		changed := m.changed
+		m.mu.Unlock()
+
+		if count == 0 {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Get returns the running job by id, or nil if not running.
+func (m *JobManager) Get(id string) *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.jobs[id]
+}
+
+// Remove removes the job.
+func (m *JobManager) Remove(job *Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.jobs[job.ID] == job {
+		delete(m.jobs, job.ID)
+
+		close(m.changed)
+		m.changed = make(chan struct{})
+	}
+}
+
+// List returns all the running jobs.
+func (m *JobManager) List() []*Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+
+	return jobs
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// readJob reads the metadata of job which the identity can access, the status is running or queued if the job is in manager,
+// and the log index is of the log being written.
+// The job of other clients is not found.
+func readJob(jobs *JobManager, identity *Identity, id string) (*entities.Job, error) {
+	job, err := jobs.Store().Get(id)
+	if err != nil || !identity.CanAccess(job.ClientID) {
+		return nil, fmt.Errorf("job(%s) not found", id)
+	}
+
+	return withLiveStatus(jobs, job), nil
+}
+
+// readJobAttempt reads the metadata of job attempt, the current attempt is read by readJob.
+// The attempt 0 means the current attempt.
+func readJobAttempt(jobs *JobManager, identity *Identity, id string, attempt int) (*entities.Job, error) {
+	job, err := readJob(jobs, identity, id)
+	if err != nil || attempt == 0 || attempt == getArchivedAttempt(job) {
+		return job, err
+	}
+
+	archived, err := jobs.Store().GetAttempt(id, attempt)
+	if err != nil || !identity.CanAccess(archived.ClientID) {
+		return nil, fmt.Errorf("job(%s) attempt(%d) not found", id, attempt)
+	}
+
+	return archived, nil
+}
+
+func withLiveStatus(jobs *JobManager, job *entities.Job) *entities.Job {
+	if j := jobs.Get(job.ID); j != nil {
+		job.LogIndex = j.LogIndex()
+		job.Status = entities.JobStatusRunning
+		if j.IsQueued() {
+			job.Status = entities.JobStatusQueued
+		}
+	} else if !isJobFinished(job.Status) {
+		job.Status = entities.JobStatusUnknown
+	}
+
+	return job
+}
+
+// isJobFinished returns whether the status is final.
+func isJobFinished(status string) bool {
+	switch status {
+	case entities.JobStatusSuccess, entities.JobStatusFailure, entities.JobStatusInterrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// MaxPageSize is the max page size of list jobs
+const MaxPageSize = 100
+
+// JobFilter is the filter of list jobs
+type JobFilter struct {
+	// Identity is the client who lists, only its own jobs are listed unless admin
+	Identity *Identity
+	//
+	Status string
+	// Keyword matches the id or script
+	Keyword string
+	//
+	Page     int
+	PageSize int
+}
+
+// listJobs lists the jobs in store, the latest created first.
+func listJobs(jobs *JobManager, filter *JobFilter) (total int, data []*entities.Job, err error) {
+	all, err := jobs.Store().List()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	matched := []*entities.Job{}
+	for _, job := range all {
+		if !filter.Identity.CanAccess(job.ClientID) {
+			continue
+		}
+
+		job = withLiveStatus(jobs, job)
+		if filter.Status != "" && job.Status != filter.Status {
+			continue
+		}
+
+		if filter.Keyword != "" && !strings.Contains(job.ID, filter.Keyword) && !strings.Contains(job.Script, filter.Keyword) {
+			continue
+		}
+
+		matched = append(matched, job)
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].CreatedAt.After(matched[j].CreatedAt)
+	})
+
+	if filter.Page < 1 {
+		filter.Page = 1
+	}
+	if filter.PageSize < 1 {
+		filter.PageSize = 20
+	}
+	if filter.PageSize > MaxPageSize {
+		filter.PageSize = MaxPageSize
+	}
+
+	// the page is compared before multiply, so that a huge page does not overflow
+	if filter.Page-1 > len(matched)/filter.PageSize {
+		return len(matched), []*entities.Job{}, nil
+	}
+
+	start := (filter.Page - 1) * filter.PageSize
+	if start > len(matched) {
+		start = len(matched)
+	}
+	end := start + filter.PageSize
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	return len(matched), matched[start:end], nil
+}
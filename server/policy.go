@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-zoox/command/engine/host"
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// Policy is the authorization of what each client may run, which is loaded from the policy file (json).
+//
+// The roles of client are the roles of its client id in Clients and the roles of its identity (like jwt),
+// or DefaultRoles if none. The command is allowed if any role allows all of it.
+type Policy struct {
+	Roles map[string]*PolicyRule `json:"roles"`
+	// Clients maps the client id to its roles
+	Clients map[string][]string `json:"clients"`
+	// DefaultRoles is the roles of client which has no role, like anonymous
+	DefaultRoles []string `json:"default_roles"`
+}
+
+// PolicyRule is the rule of role, the values are glob patterns (* means any),
+// and an empty list only allows the default value, which is host for engine and empty for the others.
+type PolicyRule struct {
+	Engines  []string `json:"engines"`
+	Images   []string `json:"images"`
+	Users    []string `json:"users"`
+	Networks []string `json:"networks"`
+	// WorkDirRoots is the allowed roots of workdir base
+	WorkDirRoots []string `json:"workdir_roots"`
+	Privileged   bool     `json:"privileged"`
+	// MaxCPU and MaxMemory cap the resources of command, which are the default if not set, 0 means unlimited
+	MaxCPU    float64 `json:"max_cpu"`
+	MaxMemory int64   `json:"max_memory"`
+}
+
+// LoadPolicy loads the policy from file, returns nil if file is empty, which allows all.
+func LoadPolicy(file string) (*Policy, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %s", err)
+	}
+
+	policy := &Policy{}
+	if err := json.Unmarshal(content, policy); err != nil {
+		return nil, fmt.Errorf("failed to decode policy file: %s", err)
+	}
+
+	for name, rule := range policy.Roles {
+		if rule == nil {
+			return nil, fmt.Errorf("role(%s) has no rule", name)
+		}
+	}
+
+	return policy, nil
+}
+
+// Authorize checks whether the client may run the command, returns the rule of the first allowed role,
+// or the denial of each role. The nil policy allows all.
+func (p *Policy) Authorize(identity *Identity, command *entities.Command) (*PolicyRule, error) {
+	if p == nil {
+		return &PolicyRule{}, nil
+	}
+
+	roles := p.getRoles(identity)
+	if len(roles) == 0 {
+		return nil, fmt.Errorf("permission denied: client(%s) has no role", identity.ClientID)
+	}
+
+	denials := []string{}
+	for _, role := range roles {
+		rule, ok := p.Roles[role]
+		if !ok {
+			denials = append(denials, fmt.Sprintf("role(%s) is not defined", role))
+			continue
+		}
+
+		if err := rule.Check(command); err != nil {
+			denials = append(denials, fmt.Sprintf("role(%s) %s", role, err))
+			continue
+		}
+
+		return rule, nil
+	}
+
+	return nil, fmt.Errorf("permission denied: %s", strings.Join(denials, "; "))
+}
+
+// getRoles returns the roles of client without duplicates.
+func (p *Policy) getRoles(identity *Identity) []string {
+	roles := []string{}
+	seen := map[string]bool{}
+	for _, role := range append(append([]string{}, p.Clients[identity.ClientID]...), identity.Roles...) {
+		if !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+
+	if len(roles) == 0 {
+		return p.DefaultRoles
+	}
+
+	return roles
+}
+
+// Check checks whether the rule allows the command.
+func (r *PolicyRule) Check(command *entities.Command) error {
+	engine := command.Engine
+	if engine == "" {
+		engine = host.Name
+	}
+	if !matchPolicy(r.Engines, engine, host.Name) {
+		return fmt.Errorf("does not allow engine: %s", engine)
+	}
+
+	if !matchPolicy(r.Images, command.Image, "") {
+		return fmt.Errorf("does not allow image: %s", command.Image)
+	}
+
+	if !matchPolicy(r.Users, command.User, "") {
+		return fmt.Errorf("does not allow user: %s", command.User)
+	}
+
+	if !matchPolicy(r.Networks, command.Network, "") {
+		return fmt.Errorf("does not allow network: %s", command.Network)
+	}
+
+	if command.WorkDirBase != "" && !isUnderRoots(r.WorkDirRoots, command.WorkDirBase) {
+		return fmt.Errorf("does not allow workdir base: %s", command.WorkDirBase)
+	}
+
+	if command.Privileged && !r.Privileged {
+		return fmt.Errorf("does not allow privileged")
+	}
+
+	if r.MaxCPU != 0 && command.CPU > r.MaxCPU {
+		return fmt.Errorf("does not allow cpu %v (max: %v)", command.CPU, r.MaxCPU)
+	}
+
+	if r.MaxMemory != 0 && command.Memory > r.MaxMemory {
+		return fmt.Errorf("does not allow memory %d (max: %d)", command.Memory, r.MaxMemory)
+	}
+
+	return nil
+}
+
+// Apply sets the max resources of rule as the default of command.
+func (r *PolicyRule) Apply(command *entities.Command) {
+	if r.MaxCPU != 0 && command.CPU == 0 {
+		command.CPU = r.MaxCPU
+	}
+
+	if r.MaxMemory != 0 && command.Memory == 0 {
+		command.Memory = r.MaxMemory
+	}
+}
+
+// matchPolicy returns whether the value matches any of the patterns, or is the default value if no pattern.
+func matchPolicy(patterns []string, value, defaultValue string) bool {
+	if len(patterns) == 0 {
+		return value == defaultValue
+	}
+
+	for _, pattern := range patterns {
+		// * in path.Match does not match /, like the registry of image
+		if pattern == "*" {
+			return true
+		}
+
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isUnderRoots returns whether the dir is one of the roots or under them, * means any.
+func isUnderRoots(roots []string, dir string) bool {
+	dir = filepath.Clean(dir)
+	for _, root := range roots {
+		if root == "*" {
+			return true
+		}
+
+		root = filepath.Clean(root)
+		if dir == root || strings.HasPrefix(dir, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
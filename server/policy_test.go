@@ -0,0 +1,257 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+const testPolicyFile = `{
+	"roles": {
+		"developer": {
+			"engines": ["host", "docker"],
+			"images": ["", "docker.io/library/*", "alpine:*"],
+			"users": ["", "nobody"],
+			"workdir_roots": ["/data/"],
+			"max_cpu": 2,
+			"max_memory": 1024
+		},
+		"ops": {
+			"engines": ["*"],
+			"images": ["*"],
+			"networks": ["*"],
+			"workdir_roots": ["*"],
+			"privileged": true
+		},
+		"guest": {}
+	},
+	"clients": {
+		"dev-1": ["developer"],
+		"ops-1": ["developer", "ops"],
+		"broken": ["unknown"]
+	},
+	"default_roles": ["guest"]
+}`
+
+func newTestPolicy(t *testing.T) *Policy {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(file, []byte(testPolicyFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := LoadPolicy(file)
+	if err != nil {
+		t.Fatalf("failed to load policy: %s", err)
+	}
+
+	return policy
+}
+
+func TestPolicyAuthorize(t *testing.T) {
+	policy := newTestPolicy(t)
+
+	testcases := []struct {
+		name     string
+		identity *Identity
+		command  *entities.Command
+		role     *PolicyRule
+		err      string
+	}{
+		{
+			name:     "default engine",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{},
+			role:     policy.Roles["developer"],
+		},
+		{
+			name:     "image glob",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{Engine: "docker", Image: "docker.io/library/alpine"},
+			role:     policy.Roles["developer"],
+		},
+		{
+			name:     "image glob does not match slash",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{Engine: "docker", Image: "docker.io/library/evil/alpine"},
+			err:      "does not allow image",
+		},
+		{
+			name:     "image tag glob",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{Engine: "docker", Image: "alpine:3.18"},
+			role:     policy.Roles["developer"],
+		},
+		{
+			name:     "engine",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{Engine: "ssh"},
+			err:      "role(developer) does not allow engine: ssh",
+		},
+		{
+			name:     "user",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{User: "root"},
+			err:      "does not allow user: root",
+		},
+		{
+			name:     "empty network only",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{Network: "host"},
+			err:      "does not allow network: host",
+		},
+		{
+			name:     "privileged",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{Privileged: true},
+			err:      "does not allow privileged",
+		},
+		{
+			name:     "max cpu",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{CPU: 4},
+			err:      "does not allow cpu 4 (max: 2)",
+		},
+		{
+			name:     "max memory",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{Memory: 2048},
+			err:      "does not allow memory 2048 (max: 1024)",
+		},
+		{
+			name:     "workdir under root",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{WorkDirBase: "/data/project"},
+			role:     policy.Roles["developer"],
+		},
+		{
+			name:     "workdir is root",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{WorkDirBase: "/data"},
+			role:     policy.Roles["developer"],
+		},
+		{
+			name:     "workdir with same prefix",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{WorkDirBase: "/database"},
+			err:      "does not allow workdir base: /database",
+		},
+		{
+			name:     "workdir escapes root",
+			identity: &Identity{ClientID: "dev-1"},
+			command:  &entities.Command{WorkDirBase: "/data/../etc"},
+			err:      "does not allow workdir base",
+		},
+		{
+			name:     "first allowed role",
+			identity: &Identity{ClientID: "ops-1"},
+			command:  &entities.Command{},
+			role:     policy.Roles["developer"],
+		},
+		{
+			name:     "next role if denied",
+			identity: &Identity{ClientID: "ops-1"},
+			command:  &entities.Command{Engine: "docker", Image: "nginx", Network: "host", Privileged: true},
+			role:     policy.Roles["ops"],
+		},
+		{
+			name:     "roles of identity",
+			identity: &Identity{ClientID: "dev-1", Roles: []string{"ops"}},
+			command:  &entities.Command{Privileged: true},
+			role:     policy.Roles["ops"],
+		},
+		{
+			name:     "default roles",
+			identity: &Identity{ClientID: "anonymous"},
+			command:  &entities.Command{},
+			role:     policy.Roles["guest"],
+		},
+		{
+			name:     "default roles deny",
+			identity: &Identity{ClientID: "anonymous"},
+			command:  &entities.Command{Engine: "docker"},
+			err:      "role(guest) does not allow engine: docker",
+		},
+		{
+			name:     "undefined role",
+			identity: &Identity{ClientID: "broken"},
+			command:  &entities.Command{},
+			err:      "role(unknown) is not defined",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule, err := policy.Authorize(tc.identity, tc.command)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if rule != tc.role {
+				t.Fatalf("expected rule %+v, got %+v", tc.role, rule)
+			}
+		})
+	}
+}
+
+func TestPolicyAuthorizeNoRole(t *testing.T) {
+	policy := &Policy{Roles: map[string]*PolicyRule{}}
+	if _, err := policy.Authorize(&Identity{ClientID: "anonymous"}, &entities.Command{}); err == nil || !strings.Contains(err.Error(), "has no role") {
+		t.Fatalf("expected no role error, got %v", err)
+	}
+
+	// the nil policy allows all
+	var nilPolicy *Policy
+	if _, err := nilPolicy.Authorize(&Identity{}, &entities.Command{Engine: "docker", Privileged: true}); err != nil {
+		t.Fatalf("expected nil policy allows all, got %s", err)
+	}
+}
+
+func TestPolicyRuleApply(t *testing.T) {
+	rule := &PolicyRule{MaxCPU: 2, MaxMemory: 1024}
+
+	command := &entities.Command{}
+	rule.Apply(command)
+	if command.CPU != 2 || command.Memory != 1024 {
+		t.Fatalf("expected the max resources as default, got cpu %v, memory %d", command.CPU, command.Memory)
+	}
+
+	command = &entities.Command{CPU: 0.5, Memory: 256}
+	rule.Apply(command)
+	if command.CPU != 0.5 || command.Memory != 256 {
+		t.Fatalf("expected the resources are kept, got cpu %v, memory %d", command.CPU, command.Memory)
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	if policy, err := LoadPolicy(""); err != nil || policy != nil {
+		t.Fatalf("expected nil policy of empty file, got %v, %v", policy, err)
+	}
+
+	testcases := map[string]string{
+		"invalid json": `{`,
+		"nil rule":     `{"roles": {"a": null}}`,
+	}
+	for name, content := range testcases {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "policy.json")
+			if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := LoadPolicy(file); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
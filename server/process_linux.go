@@ -0,0 +1,54 @@
+//go:build linux
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// findProcesses finds the processes of the command by the runner id in environment,
+// which is injected into the shell by command and inherited by its children.
+func findProcesses(runnerID string) ([]*os.Process, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	env := []byte(fmt.Sprintf("%s=%s", envCommandID, runnerID))
+	processes := []*os.Process{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		environ, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+		if err != nil {
+			continue
+		}
+
+		if !hasEnv(environ, env) {
+			continue
+		}
+
+		if process, err := os.FindProcess(pid); err == nil {
+			processes = append(processes, process)
+		}
+	}
+
+	return processes, nil
+}
+
+// hasEnv returns whether the environ (separated by NUL) has the exact env of key=value.
+func hasEnv(environ []byte, env []byte) bool {
+	for _, e := range bytes.Split(environ, []byte{0}) {
+		if bytes.Equal(e, env) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,22 @@
+package server
+
+import "testing"
+
+func TestHasEnv(t *testing.T) {
+	env := []byte("GO_ZOOX_COMMAND_ID=go-zoox_caas_job_1")
+
+	testcases := map[string]bool{
+		"GO_ZOOX_COMMAND_ID=go-zoox_caas_job_1\x00":                     true,
+		"PATH=/bin\x00GO_ZOOX_COMMAND_ID=go-zoox_caas_job_1\x00A=1\x00": true,
+		"PATH=/bin\x00GO_ZOOX_COMMAND_ID=go-zoox_caas_job_1":            true,
+		"X_GO_ZOOX_COMMAND_ID=go-zoox_caas_job_1\x00":                   false,
+		"GO_ZOOX_COMMAND_ID=go-zoox_caas_job_12\x00":                    false,
+		"A=GO_ZOOX_COMMAND_ID=go-zoox_caas_job_1\x00":                   false,
+	}
+
+	for environ, expected := range testcases {
+		if ok := hasEnv([]byte(environ), env); ok != expected {
+			t.Fatalf("expected %v of environ %q, got %v", expected, environ, ok)
+		}
+	}
+}
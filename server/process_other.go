@@ -0,0 +1,14 @@
+//go:build !linux
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// findProcesses finds the processes of the command by the runner id, which is only supported on linux.
+func findProcesses(runnerID string) ([]*os.Process, error) {
+	return nil, fmt.Errorf("find processes is not supported on %s", runtime.GOOS)
+}
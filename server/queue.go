@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrQueueTimeout is returned when waiting in queue is timeout
+var ErrQueueTimeout = fmt.Errorf("queue timeout")
+
+// ErrQueueCancelled is returned when the waiting is cancelled
+var ErrQueueCancelled = fmt.Errorf("queue cancelled")
+
+// Queue limits the concurrent running jobs, the others wait in FIFO order.
+type Queue struct {
+	mu      sync.Mutex
+	max     int
+	running int
+	waiting []*queueTicket
+}
+
+type queueTicket struct {
+	ready      chan struct{}
+	granted    bool
+	onPosition func(position int)
+}
+
+// NewQueue creates a queue, max <= 0 means unlimited.
+func NewQueue(max int) *Queue {
+	return &Queue{
+		max: max,
+	}
+}
+
+// Acquire waits until the job is allowed to run, onPosition is called when the position (from 1) changes.
+// timeout <= 0 means waiting forever.
+func (q *Queue) Acquire(cancel <-chan struct{}, timeout time.Duration, onPosition func(position int)) error {
+	q.mu.Lock()
+	if q.max <= 0 || (q.running < q.max && len(q.waiting) == 0) {
+		q.running++
+		q.mu.Unlock()
+		return nil
+	}
+
+	ticket := &queueTicket{
+		ready:      make(chan struct{}),
+		onPosition: onPosition,
+	}
+	q.waiting = append(q.waiting, ticket)
+	position := len(q.waiting)
+	q.mu.Unlock()
+
+	if onPosition != nil {
+		onPosition(position)
+	}
+
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case <-ticket.ready:
+		return nil
+	case <-cancel:
+		return q.leave(ticket, ErrQueueCancelled)
+	case <-timeoutCh:
+		return q.leave(ticket, ErrQueueTimeout)
+	}
+}
+
+// Release releases the running slot, the first waiting job is allowed to run.
+func (q *Queue) Release() {
+	q.mu.Lock()
+	if len(q.waiting) == 0 {
+		if q.running > 0 {
+			q.running--
+		}
+		q.mu.Unlock()
+		return
+	}
+
+	ticket := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	ticket.granted = true
+	close(ticket.ready)
+	waiting := append([]*queueTicket{}, q.waiting...)
+	q.mu.Unlock()
+
+	q.notify(waiting)
+}
+
+// Running returns the count of running jobs.
+func (q *Queue) Running() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.running
+}
+
+// Waiting returns the count of waiting jobs.
+func (q *Queue) Waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.waiting)
+}
+
+// leave removes the ticket from queue, the slot is released if it is granted at the same time.
+func (q *Queue) leave(ticket *queueTicket, err error) error {
+	q.mu.Lock()
+	if ticket.granted {
+		q.mu.Unlock()
+		q.Release()
+		return err
+	}
+
+	for i, t := range q.waiting {
+		if t == ticket {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			break
+		}
+	}
+	waiting := append([]*queueTicket{}, q.waiting...)
+	q.mu.Unlock()
+
+	q.notify(waiting)
+	return err
+}
+
+func (q *Queue) notify(waiting []*queueTicket) {
+	for i, t := range waiting {
+		if t.onPosition != nil {
+			t.onPosition(i + 1)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// waitQueue waits until the count of waiting jobs is n.
+func waitQueue(t *testing.T, q *Queue, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for q.Waiting() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiting, got %d", n, q.Waiting())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueueUnlimited(t *testing.T) {
+	q := NewQueue(0)
+	for i := 0; i < 100; i++ {
+		if err := q.Acquire(nil, time.Millisecond, nil); err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+	}
+
+	if q.Waiting() != 0 {
+		t.Fatalf("expected no waiting, got %d", q.Waiting())
+	}
+}
+
+func TestQueueFIFO(t *testing.T) {
+	q := NewQueue(1)
+	if err := q.Acquire(nil, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan int, 5)
+	for i := 1; i <= 5; i++ {
+		go func(i int) {
+			if err := q.Acquire(nil, 0, nil); err != nil {
+				t.Errorf("job(%d) expected no error, got %s", i, err)
+			}
+			granted <- i
+		}(i)
+
+		// enqueue one by one, so that the order of queue is known
+		waitQueue(t, q, i)
+	}
+
+	// one job is granted by each release
+	for i := 1; i <= 5; i++ {
+		q.Release()
+		if id := <-granted; id != i {
+			t.Fatalf("expected job(%d) in FIFO order, got job(%d)", i, id)
+		}
+	}
+
+	if q.Running() != 1 {
+		t.Fatalf("expected 1 running, got %d", q.Running())
+	}
+
+	q.Release()
+	if q.Running() != 0 {
+		t.Fatalf("expected 0 running, got %d", q.Running())
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	q := NewQueue(1)
+	if err := q.Acquire(nil, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	startAt := time.Now()
+	if err := q.Acquire(nil, 50*time.Millisecond, nil); err != ErrQueueTimeout {
+		t.Fatalf("expected %s, got %v", ErrQueueTimeout, err)
+	}
+	if elapsed := time.Since(startAt); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected waiting for timeout, got %s", elapsed)
+	}
+	if q.Waiting() != 0 {
+		t.Fatalf("expected the timeout job to leave queue, got %d waiting", q.Waiting())
+	}
+
+	// the slot is still held by the first job
+	q.Release()
+	if err := q.Acquire(nil, 50*time.Millisecond, nil); err != nil {
+		t.Fatalf("expected no error after release, got %s", err)
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	q := NewQueue(1)
+	if err := q.Acquire(nil, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Acquire(cancel, 0, nil)
+	}()
+	waitQueue(t, q, 1)
+
+	close(cancel)
+	if err := <-errCh; err != ErrQueueCancelled {
+		t.Fatalf("expected %s, got %v", ErrQueueCancelled, err)
+	}
+	if q.Waiting() != 0 {
+		t.Fatalf("expected the cancelled job to leave queue, got %d waiting", q.Waiting())
+	}
+}
+
+func TestQueuePosition(t *testing.T) {
+	q := NewQueue(1)
+	if err := q.Acquire(nil, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel := make(chan struct{})
+	go q.Acquire(cancel, 0, nil)
+	waitQueue(t, q, 1)
+
+	positions := make(chan int, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Acquire(nil, 0, func(position int) {
+			positions <- position
+		})
+	}()
+	waitQueue(t, q, 2)
+
+	if position := <-positions; position != 2 {
+		t.Fatalf("expected position 2, got %d", position)
+	}
+
+	// the first waiting job leaves, the second moves forward
+	close(cancel)
+	if position := <-positions; position != 1 {
+		t.Fatalf("expected position 1, got %d", position)
+	}
+
+	q.Release()
+	if err := <-done; err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// Quota limits the usage of each client, the anonymous client (no auth) shares one quota.
+type Quota struct {
+	cfg *Config
+	//
+	mu      sync.Mutex
+	clients map[string]*quotaUsage
+}
+
+type quotaUsage struct {
+	connections int
+	jobs        int
+	cpu         float64
+	memory      int64
+	// starts is the start time of jobs in the last minute
+	starts []time.Time
+}
+
+// NewQuota creates a quota by the limits of config.
+func NewQuota(cfg *Config) *Quota {
+	return &Quota{
+		cfg:     cfg,
+		clients: map[string]*quotaUsage{},
+	}
+}
+
+// Connect adds a connection of client, returns error if the connection limit is exceeded.
+func (q *Quota) Connect(clientID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := q.get(clientID)
+	if q.cfg.MaxConnectionsPerClient > 0 && usage.connections >= int(q.cfg.MaxConnectionsPerClient) {
+		return fmt.Errorf("quota exceeded: max connections per client is %d", q.cfg.MaxConnectionsPerClient)
+	}
+
+	usage.connections++
+	return nil
+}
+
+// Disconnect removes a connection of client.
+func (q *Quota) Disconnect(clientID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := q.get(clientID)
+	if usage.connections > 0 {
+		usage.connections--
+	}
+	q.gc(clientID)
+}
+
+// Acquire adds a job of client, returns error if any limit is exceeded.
+func (q *Quota) Acquire(clientID string, command *entities.Command) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// the negative resources would lower the usage
+	if command.CPU < 0 || command.Memory < 0 {
+		return fmt.Errorf("invalid resources: cpu %g, memory %d", command.CPU, command.Memory)
+	}
+
+	usage := q.get(clientID)
+	if q.cfg.MaxJobsPerClient > 0 && usage.jobs >= int(q.cfg.MaxJobsPerClient) {
+		return fmt.Errorf("quota exceeded: max concurrent jobs per client is %d", q.cfg.MaxJobsPerClient)
+	}
+
+	now := time.Now()
+	starts := usage.starts[:0]
+	for _, start := range usage.starts {
+		if now.Sub(start) < time.Minute {
+			starts = append(starts, start)
+		}
+	}
+	usage.starts = starts
+	if q.cfg.MaxJobsPerMinutePerClient > 0 && len(usage.starts) >= int(q.cfg.MaxJobsPerMinutePerClient) {
+		return fmt.Errorf("quota exceeded: max jobs per minute per client is %d", q.cfg.MaxJobsPerMinutePerClient)
+	}
+
+	if q.cfg.MaxCPUPerClient > 0 && usage.cpu+command.CPU > q.cfg.MaxCPUPerClient {
+		return fmt.Errorf("quota exceeded: max cpu per client is %g, %g in use, %g requested", q.cfg.MaxCPUPerClient, usage.cpu, command.CPU)
+	}
+
+	if q.cfg.MaxMemoryPerClient > 0 && usage.memory+command.Memory > q.cfg.MaxMemoryPerClient {
+		return fmt.Errorf("quota exceeded: max memory per client is %d, %d in use, %d requested", q.cfg.MaxMemoryPerClient, usage.memory, command.Memory)
+	}
+
+	usage.jobs++
+	usage.cpu += command.CPU
+	usage.memory += command.Memory
+	usage.starts = append(usage.starts, now)
+	return nil
+}
+
+// Release removes a job of client.
+func (q *Quota) Release(clientID string, command *entities.Command) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := q.get(clientID)
+	if usage.jobs > 0 {
+		usage.jobs--
+	}
+	usage.cpu -= command.CPU
+	usage.memory -= command.Memory
+	q.gc(clientID)
+}
+
+func (q *Quota) get(clientID string) *quotaUsage {
+	usage, ok := q.clients[clientID]
+	if !ok {
+		usage = &quotaUsage{}
+		q.clients[clientID] = usage
+	}
+
+	return usage
+}
+
+// gc removes the idle client, whose jobs per minute is expired.
+func (q *Quota) gc(clientID string) {
+	usage := q.clients[clientID]
+	if usage.connections != 0 || usage.jobs != 0 {
+		return
+	}
+
+	if len(usage.starts) == 0 || time.Since(usage.starts[len(usage.starts)-1]) >= time.Minute {
+		delete(q.clients, clientID)
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+func TestQuotaConnections(t *testing.T) {
+	q := NewQuota(&Config{MaxConnectionsPerClient: 2})
+
+	for i := 0; i < 2; i++ {
+		if err := q.Connect("a"); err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+	}
+	if err := q.Connect("a"); err == nil || !strings.Contains(err.Error(), "max connections") {
+		t.Fatalf("expected max connections error, got %v", err)
+	}
+
+	// the other client has its own quota
+	if err := q.Connect("b"); err != nil {
+		t.Fatalf("expected no error of other client, got %s", err)
+	}
+
+	q.Disconnect("a")
+	if err := q.Connect("a"); err != nil {
+		t.Fatalf("expected no error after disconnect, got %s", err)
+	}
+}
+
+func TestQuotaJobs(t *testing.T) {
+	q := NewQuota(&Config{MaxJobsPerClient: 2})
+	command := &entities.Command{}
+
+	for i := 0; i < 2; i++ {
+		if err := q.Acquire("a", command); err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+	}
+	if err := q.Acquire("a", command); err == nil || !strings.Contains(err.Error(), "max concurrent jobs") {
+		t.Fatalf("expected max jobs error, got %v", err)
+	}
+
+	q.Release("a", command)
+	if err := q.Acquire("a", command); err != nil {
+		t.Fatalf("expected no error after release, got %s", err)
+	}
+}
+
+func TestQuotaJobsPerMinute(t *testing.T) {
+	q := NewQuota(&Config{MaxJobsPerMinutePerClient: 2})
+	command := &entities.Command{}
+
+	for i := 0; i < 2; i++ {
+		if err := q.Acquire("a", command); err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		q.Release("a", command)
+	}
+
+	// the released jobs are still counted in the last minute
+	if err := q.Acquire("a", command); err == nil || !strings.Contains(err.Error(), "max jobs per minute") {
+		t.Fatalf("expected max jobs per minute error, got %v", err)
+	}
+}
+
+func TestQuotaResources(t *testing.T) {
+	q := NewQuota(&Config{MaxCPUPerClient: 2, MaxMemoryPerClient: 1024})
+
+	first := &entities.Command{CPU: 1.5, Memory: 512}
+	if err := q.Acquire("a", first); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	if err := q.Acquire("a", &entities.Command{CPU: 1}); err == nil || !strings.Contains(err.Error(), "max cpu") {
+		t.Fatalf("expected max cpu error, got %v", err)
+	}
+	if err := q.Acquire("a", &entities.Command{Memory: 1024}); err == nil || !strings.Contains(err.Error(), "max memory") {
+		t.Fatalf("expected max memory error, got %v", err)
+	}
+
+	// the rejected jobs are not counted
+	second := &entities.Command{CPU: 0.5, Memory: 512}
+	if err := q.Acquire("a", second); err != nil {
+		t.Fatalf("expected no error within quota, got %s", err)
+	}
+
+	q.Release("a", first)
+	q.Release("a", second)
+	if err := q.Acquire("a", &entities.Command{CPU: 2, Memory: 1024}); err != nil {
+		t.Fatalf("expected no error after release, got %s", err)
+	}
+}
+
+func TestQuotaRejectsNegativeResources(t *testing.T) {
+	q := NewQuota(&Config{MaxCPUPerClient: 1, MaxMemoryPerClient: 1024})
+
+	for _, command := range []*entities.Command{{CPU: -100}, {Memory: -1024}} {
+		if err := q.Acquire("a", command); err == nil || !strings.Contains(err.Error(), "invalid resources") {
+			t.Fatalf("expected invalid resources error, got %v", err)
+		}
+	}
+
+	// the usage is not lowered by the rejected jobs
+	if err := q.Acquire("a", &entities.Command{CPU: 1, Memory: 1024}); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if err := q.Acquire("a", &entities.Command{CPU: 1}); err == nil {
+		t.Fatal("expected max cpu error")
+	}
+}
+
+func TestQuotaGC(t *testing.T) {
+	q := NewQuota(&Config{})
+	command := &entities.Command{}
+
+	q.Connect("a")
+	q.Acquire("a", command)
+	q.Release("a", command)
+	q.Disconnect("a")
+
+	// the client is kept until its jobs per minute is expired
+	if _, ok := q.clients["a"]; !ok {
+		t.Fatal("expected the client of recent job to be kept")
+	}
+
+	q.Connect("b")
+	q.Disconnect("b")
+	if _, ok := q.clients["b"]; ok {
+		t.Fatal("expected the idle client to be removed")
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+	"github.com/go-zoox/fs"
+	"github.com/go-zoox/logger"
+)
+
+// recoverJobs marks the jobs which were running when the server crashed as interrupted,
+// and cleans their workdirs if IsAutoCleanWorkDir.
+// The jobs of other instances sharing the store are running by them, which are not touched,
+// while all jobs of the store which is not shared are recovered.
+func recoverJobs(cfg *Config, store JobStore) error {
+	records, err := store.List()
+	if err != nil {
+		return fmt.Errorf("failed to list jobs: %s", err)
+	}
+
+	count := 0
+	for _, record := range records {
+		if isJobFinished(record.Status) {
+			continue
+		}
+
+		// the record without instance is created before instance is recorded
+		if cfg.IsSharedJobStore() && record.Instance != "" && record.Instance != cfg.InstanceID {
+			continue
+		}
+
+		logger.Infof("[recover] job(%s) is interrupted", record.ID)
+		finishedAt := time.Now().UTC()
+		record.Status = entities.JobStatusInterrupted
+		record.FinishedAt = &finishedAt
+		record.Exit = &entities.Exit{Code: -1, Reason: entities.ExitReasonInterrupted, Message: "interrupted by server restart"}
+		if err := store.Update(record); err != nil {
+			logger.Errorf("[recover] failed to update job(%s): %s", record.ID, err)
+			continue
+		}
+		count++
+
+		workDir := cfg.GetJobWorkDir(record)
+		if cfg.IsAutoCleanWorkDir && fs.IsExist(workDir) {
+			logger.Infof("[recover] clean work dir: %s", workDir)
+			if err := fs.Remove(workDir); err != nil {
+				logger.Errorf("[recover] failed to clean workdir(%s): %s", workDir, err)
+			}
+		}
+	}
+
+	if count != 0 {
+		logger.Infof("[recover] %d interrupted jobs are recovered", count)
+	}
+
+	return nil
+}
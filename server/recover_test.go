@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+func TestRecoverJobs(t *testing.T) {
+	for name, store := range newTestJobStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testRecoverJobs(t, store, &Config{WorkDir: t.TempDir(), IsAutoCleanWorkDir: true, InstanceID: "instance-1"})
+		})
+	}
+
+	// the store of kv is shared by instances with redis, which is simulated by config
+	t.Run("shared", func(t *testing.T) {
+		testRecoverJobs(t, newTestJobStores(t)["kv"], &Config{
+			WorkDir:            t.TempDir(),
+			IsAutoCleanWorkDir: true,
+			InstanceID:         "instance-1",
+			JobStore:           JobStoreKV,
+			JobStoreKVEngine:   "redis",
+		})
+	})
+}
+
+func testRecoverJobs(t *testing.T, store JobStore, cfg *Config) {
+	t.Helper()
+
+	jobs := map[string]string{
+		"finished": entities.JobStatusSuccess,
+		"failed":   entities.JobStatusFailure,
+		"queued":   entities.JobStatusQueued,
+		"running":  entities.JobStatusRunning,
+		"own":      entities.JobStatusRunning,
+		"other":    entities.JobStatusRunning,
+		"custom":   entities.JobStatusRunning,
+	}
+	instances := map[string]string{
+		"own":   "instance-1",
+		"other": "instance-2",
+	}
+	// the workdir under the custom workdir base is recorded
+	workDirs := map[string]string{
+		"custom": fmt.Sprintf("%s/custom", t.TempDir()),
+	}
+	for id, status := range jobs {
+		if err := store.Create(&entities.Job{ID: id, Status: status, Instance: instances[id], WorkDir: workDirs[id]}); err != nil {
+			t.Fatal(err)
+		}
+		if workDirs[id] == "" {
+			workDirs[id] = cfg.GetWorkDir(id, 0)
+		}
+		if err := os.MkdirAll(workDirs[id], 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := recoverJobs(cfg, store); err != nil {
+		t.Fatalf("failed to recover jobs: %s", err)
+	}
+
+	for id, status := range jobs {
+		// the running job of other instance is not touched in the shared store
+		isInterrupted := !isJobFinished(status) && !(cfg.IsSharedJobStore() && id == "other")
+		expected := status
+		if isInterrupted {
+			expected = entities.JobStatusInterrupted
+		}
+
+		job, err := store.Get(id)
+		if err != nil {
+			t.Fatalf("failed to get job(%s): %s", id, err)
+		}
+		if job.Status != expected {
+			t.Fatalf("expected job(%s) status %s, got %s", id, expected, job.Status)
+		}
+		if isInterrupted && (job.Exit == nil || job.Exit.Reason != entities.ExitReasonInterrupted || job.FinishedAt == nil) {
+			t.Fatalf("unexpected interrupted job(%s): %+v", id, job)
+		}
+
+		// only the workdir of interrupted job is cleaned
+		_, err = os.Stat(workDirs[id])
+		if isInterrupted != os.IsNotExist(err) {
+			t.Fatalf("expected workdir of job(%s) cleaned %v, got %v", id, isInterrupted, err)
+		}
+	}
+}
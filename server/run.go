@@ -0,0 +1,486 @@
+package server
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-zoox/command"
+	"github.com/go-zoox/command/engine/host"
+	"github.com/go-zoox/command/errors"
+	"github.com/go-zoox/commands-as-a-service/entities"
+	"github.com/go-zoox/fs"
+	"github.com/go-zoox/logger"
+)
+
+// failJob writes the error message and exit to the viewer before the job runs.
+func failJob(viewer Viewer, reason string, message string) {
+	viewer.WriteOutput(entities.MessageCommandStderr, []byte(message+"\n"))
+	viewer.WriteExit(&entities.Exit{Code: 1, Reason: reason, Message: message})
+}
+
+// reuseJob replies the job with the same id instead of running it again, returns false if not found.
+// The running job is followed until exit or the job is cancelled, the finished job replies its stored log and exit,
+// and the detached job replies the id. The job of other clients is not reused, which fails the submission.
+func reuseJob(jobs *JobManager, identity *Identity, job *Job, id string, viewer Viewer, onDetached func(id string)) bool {
+	running := jobs.Get(id)
+	clientID := ""
+	if running != nil {
+		clientID = running.ClientID
+	} else if record, err := jobs.Store().Get(id); err == nil {
+		clientID = record.ClientID
+	} else {
+		return false
+	}
+
+	if !identity.CanAccess(clientID) {
+		logger.Infof("[command] client(%s) denied: job(%s) is owned by other client", job.ClientID, id)
+		failJob(viewer, entities.ExitReasonPermissionDenied, fmt.Sprintf("job(%s) already exists", id))
+		return true
+	}
+
+	job.ID = id
+	logger.Infof("[command] job(%s) exists, reuse it (running: %v)", id, running != nil)
+	if job.CommandN.Detached {
+		onDetached(id)
+		return true
+	}
+
+	if err := attachJob(jobs, identity, &entities.Attach{ID: id}, viewer); err != nil {
+		failJob(viewer, entities.ExitReasonInternalError, err.Error())
+		return true
+	}
+
+	if running != nil {
+		select {
+		case <-running.done:
+		case <-job.Cancelled():
+		}
+	}
+
+	return true
+}
+
+// finishCancelled finishes the job which is cancelled before its command is started.
+func finishCancelled(job *Job, commandN *entities.Command, finish func(status string, exit *entities.Exit)) {
+	logger.Infof("[command] cancelled before start: %s", commandN.Script)
+	exit := &entities.Exit{Code: -1, Reason: entities.ExitReasonKilled, Message: "cancelled before start"}
+	status := entities.JobStatusFailure
+	if job.IsKilledByClose() {
+		exit.Message = "killed by connection close"
+	} else if job.IsInterrupted() {
+		exit.Reason = entities.ExitReasonInterrupted
+		exit.Message = "interrupted by server shutdown"
+		status = entities.JobStatusInterrupted
+	}
+
+	finish(status, exit)
+}
+
+// getExitStatus returns the exit code and signal name of the exited command, ok is false if the command is not exited.
+// The signal is from the wait status, or parsed from the error of engine which only keeps the message.
+func getExitStatus(err error) (code int, signal string, ok bool) {
+	switch errx := err.(type) {
+	case *exec.ExitError:
+		if status, ok := errx.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return errx.ExitCode(), entities.ExitSignalName(status.Signal()), true
+		}
+
+		return errx.ExitCode(), "", true
+	case *errors.ExitError:
+		return errx.ExitCode(), entities.ParseSignal(errx.Error()), true
+	default:
+		return 0, "", false
+	}
+}
+
+// checkCommandLimits rejects the negative resources and sizes, which pass the caps of policy and quota.
+func checkCommandLimits(command *entities.Command) error {
+	switch {
+	case command.CPU < 0:
+		return fmt.Errorf("invalid cpu: %v", command.CPU)
+	case command.Memory < 0:
+		return fmt.Errorf("invalid memory: %d", command.Memory)
+	case command.Timeout < 0:
+		return fmt.Errorf("invalid timeout: %d", command.Timeout)
+	case command.Rows < 0 || command.Cols < 0:
+		return fmt.Errorf("invalid terminal size: %dx%d", command.Rows, command.Cols)
+	}
+
+	return nil
+}
+
+// runJob runs the command of job, the output and exit are written to the viewer,
+// while the detached job only writes log and replies its id by onDetached.
+//
+// The job.ID is the default id, which is overridden by the id of command.
+// The submission with the id of command is idempotent unless force, see reuseJob.
+// The job is finished by runJob, which closes its stdin, so the caller does not finish it.
+func runJob(cfg *Config, jobs *JobManager, job *Job, viewer Viewer, onDetached func(id string)) {
+	defer job.Finish()
+
+	commandN := job.CommandN
+	tmpScriptFilepath := ""
+
+	if commandN.Detached && (commandN.TTY || commandN.Stdin) {
+		failJob(viewer, entities.ExitReasonInvalidRequest, "detached command does not support tty or stdin")
+		return
+	}
+
+	id := job.ID
+	if commandN.ID != "" {
+		id = commandN.ID
+	}
+	if !isValidJobID(id) {
+		failJob(viewer, entities.ExitReasonInvalidRequest, "invalid job id")
+		return
+	}
+
+	if commandN.Template != "" {
+		if err := jobs.Commands().Render(commandN); err != nil {
+			failJob(viewer, entities.ExitReasonInvalidRequest, err.Error())
+			return
+		}
+	} else if err := jobs.Commands().Check(commandN.Script); err != nil {
+		logger.Infof("[command] client(%s) denied: %s", job.ClientID, err)
+		failJob(viewer, entities.ExitReasonPermissionDenied, err.Error())
+		return
+	}
+
+	if err := checkCommandLimits(commandN); err != nil {
+		failJob(viewer, entities.ExitReasonInvalidRequest, err.Error())
+		return
+	}
+
+	identity := job.Identity
+	if identity == nil {
+		identity = &Identity{ClientID: job.ClientID}
+	}
+	if !identity.Allows(ScopeExec) {
+		logger.Infof("[command] client(%s) denied: %s scope is required", job.ClientID, ScopeExec)
+		failJob(viewer, entities.ExitReasonPermissionDenied, fmt.Sprintf("permission denied: %s scope is required", ScopeExec))
+		return
+	}
+	if err := identity.Apply(commandN); err != nil {
+		logger.Infof("[command] client(%s) denied: %s", job.ClientID, err)
+		failJob(viewer, entities.ExitReasonPermissionDenied, err.Error())
+		return
+	}
+	rule, err := jobs.Policy().Authorize(identity, commandN)
+	if err != nil {
+		logger.Infof("[command] client(%s) denied: %s", job.ClientID, err)
+		failJob(viewer, entities.ExitReasonPermissionDenied, err.Error())
+		return
+	}
+	rule.Apply(commandN)
+
+	attempt := 1
+	if commandN.ID != "" {
+		if !commandN.Force {
+			if reuseJob(jobs, identity, job, id, viewer, onDetached) {
+				return
+			}
+		} else if jobs.Get(id) != nil {
+			failJob(viewer, entities.ExitReasonInvalidRequest, fmt.Sprintf("job(%s) is already running", id))
+			return
+		} else if last, err := jobs.Store().Get(id); err == nil {
+			if !identity.CanAccess(last.ClientID) {
+				logger.Infof("[command] client(%s) denied: job(%s) is owned by other client", job.ClientID, id)
+				failJob(viewer, entities.ExitReasonPermissionDenied, fmt.Sprintf("job(%s) already exists", id))
+				return
+			}
+
+			attempt = last.Attempt + 1
+			if last.Attempt == 0 {
+				attempt = 2
+			}
+		}
+	}
+
+	if err := jobs.Quota().Acquire(job.ClientID, commandN); err != nil {
+		logger.Infof("[command] client(%s) rejected: %s", job.ClientID, err)
+		failJob(viewer, entities.ExitReasonQuotaExceeded, err.Error())
+		return
+	}
+	defer jobs.Quota().Release(job.ClientID, commandN)
+
+	cmdCfg, err := cfg.GetCommandConfig(id, attempt, commandN)
+	if err != nil {
+		logger.Errorf("failed to get command config: %s", err)
+		failJob(viewer, entities.ExitReasonInternalError, "internal server error")
+		return
+	}
+
+	job.ID = id
+	if jobs.IsClosed() {
+		failJob(viewer, entities.ExitReasonUnavailable, "server is shutting down")
+		return
+	}
+	if !jobs.Add(job) {
+		// the same id is submitted at the same time
+		if commandN.ID != "" && !commandN.Force && reuseJob(jobs, identity, job, id, viewer, onDetached) {
+			return
+		}
+
+		failJob(viewer, entities.ExitReasonInvalidRequest, fmt.Sprintf("job(%s) is already running", id))
+		return
+	}
+	defer jobs.Remove(job)
+	// make sure viewers are notified even if panic
+	defer job.Done(&entities.Exit{Code: -1, Reason: entities.ExitReasonInternalError, Message: "job is interrupted"})
+
+	env := []string{}
+	environment := map[string]string{
+		// "HOME":    os.Getenv("HOME"),
+		// "USER":    os.Getenv("USER"),
+		// "LOGNAME": os.Getenv("LOGNAME"),
+		// "SHELL":   cfg.Shell,
+		// "TERM":    os.Getenv("TERM"),
+		// "PATH":    os.Getenv("PATH"),
+	}
+	if commandN.Environment != nil {
+		for k, v := range commandN.Environment {
+			environment[k] = v
+		}
+	}
+	if cfg.Environment != nil {
+		for k, v := range cfg.Environment {
+			environment[k] = v
+		}
+	}
+	// the runner id is reserved to find the processes of command, see findProcesses
+	delete(environment, envCommandID)
+	envKeys := []string{}
+	for k, v := range environment {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+
+	store := jobs.Store()
+	record := &entities.Job{
+		ID:         id,
+		ClientID:   job.ClientID,
+		Instance:   cfg.InstanceID,
+		Attempt:    attempt,
+		Script:     commandN.Script,
+		ScriptHash: entities.HashScript(commandN.Script),
+		Template:   commandN.Template,
+		EnvKeys:    envKeys,
+		Engine:     commandN.Engine,
+		Image:      commandN.Image,
+		WorkDir:    cmdCfg.WorkDir,
+		Status:     entities.JobStatusRunning,
+		CreatedAt:  time.Now().UTC(),
+		LogVersion: entities.LogVersion,
+	}
+	if err := store.Create(record); err != nil {
+		logger.Errorf("failed to create job record: %s", err)
+		failJob(viewer, entities.ExitReasonInternalError, "internal server error")
+		return
+	}
+	log := newJobLog(store, id, cfg.MaxLogSize)
+	job.SetLog(log)
+
+	// finish records the final status and exit of job, and notifies the viewers
+	finish := func(status string, exit *entities.Exit) {
+		finishedAt := time.Now().UTC()
+		record.Status = status
+		record.FinishedAt = &finishedAt
+		record.Exit = exit
+		record.StdoutBytes, record.StderrBytes = job.OutputBytes()
+		if err := log.Close(); err != nil {
+			logger.Errorf("failed to close job log: %s", err)
+		}
+		record.LogIndex = log.Index()
+		if err := store.CloseLog(id, cfg.IsCompressLog); err != nil {
+			logger.Errorf("failed to close job log: %s", err)
+		}
+		if err := store.Update(record); err != nil {
+			logger.Errorf("failed to update job record: %s", err)
+		}
+
+		job.Done(exit)
+	}
+
+	defer func() {
+		// @TODO clean workdir
+		if cfg.IsAutoCleanWorkDir {
+			if fs.IsExist(cmdCfg.WorkDir) {
+				logger.Infof("[command] clean work dir: %s", cmdCfg.WorkDir)
+				if err := fs.Remove(cmdCfg.WorkDir); err != nil {
+					panic(fmt.Errorf("failed to clean workdir(%s): %s", cmdCfg.WorkDir, err))
+				}
+			}
+		}
+	}()
+
+	if commandN.Detached {
+		// detached job only writes log, and is not killed by connection close
+		onDetached(id)
+		logger.Infof("[command] detached: %s (id: %s)", commandN.Script, id)
+	} else {
+		job.Subscribe(viewer)
+	}
+
+	// queue
+	err = jobs.Acquire(job, time.Duration(cfg.QueueTimeout)*time.Second, func(position int) {
+		if v, ok := viewer.(QueueViewer); ok && !commandN.Detached {
+			v.WriteQueued(&entities.Queue{Position: position})
+		}
+	})
+	if err != nil {
+		exit := &entities.Exit{Code: -1, Reason: entities.ExitReasonKilled, Message: err.Error()}
+		status := entities.JobStatusFailure
+		if err == ErrQueueTimeout {
+			exit.Reason = entities.ExitReasonQueueTimeout
+			job.Output(entities.MessageCommandStderr).Write([]byte("queue timeout\n"))
+		} else if job.IsInterrupted() {
+			exit.Reason = entities.ExitReasonInterrupted
+			status = entities.JobStatusInterrupted
+		}
+
+		logger.Infof("[command] failed to wait in queue: %s (err: %s)", commandN.Script, err)
+		finish(status, exit)
+		return
+	}
+	defer jobs.Release()
+
+	// the job may be cancelled (or interrupted) after it leaves the queue, before the command is set
+	if job.IsCancelled() {
+		finishCancelled(job, commandN, finish)
+		return
+	}
+
+	// runner id is used to find the processes for signal in host engine
+	if commandN.Engine == "" || commandN.Engine == host.Name {
+		job.RunnerID = fmt.Sprintf("go-zoox_caas_%s_%d", id, time.Now().UnixNano())
+	}
+	cmd, err := command.New(&command.Config{
+		ID:          job.RunnerID,
+		Command:     commandN.Script,
+		Shell:       cfg.Shell,
+		WorkDir:     cmdCfg.WorkDir,
+		Environment: environment,
+		User:        commandN.User,
+		Engine:      commandN.Engine,
+		Image:       commandN.Image,
+		Memory:      commandN.Memory,
+		CPU:         commandN.CPU,
+		Platform:    commandN.Platform,
+		Network:     commandN.Network,
+		Privileged:  commandN.Privileged,
+	})
+	if err != nil {
+		logger.Errorf("failed to create command: %s", err)
+		job.Output(entities.MessageCommandStderr).Write([]byte(fmt.Sprintf("failed to create command: %s\n", err)))
+		finish(entities.JobStatusFailure, &entities.Exit{Code: -1, Reason: entities.ExitReasonSpawnFailed, Message: err.Error()})
+		return
+	}
+	if err := job.SetCmd(cmd); err != nil {
+		finishCancelled(job, commandN, finish)
+		return
+	}
+
+	// timeout
+	var isTimeout atomic.Bool
+	timeout := cfg.GetTimeout(commandN)
+	if timeout != 0 {
+		commandTimeoutTimer := time.AfterFunc(timeout, func() {
+			isTimeout.Store(true)
+			logger.Infof("[command] timeout after %s: %s", timeout, commandN.Script)
+			if err := job.Terminate(time.Duration(cfg.TimeoutGracePeriod) * time.Second); err != nil {
+				logger.Errorf("[command] failed to terminate: %s", err)
+			}
+		})
+		defer commandTimeoutTimer.Stop()
+	}
+
+	// stdin
+	if commandN.Stdin && !commandN.TTY {
+		cmd.SetStdin(job.Stdin())
+	}
+
+	stdout := job.Output(entities.MessageCommandStdout)
+	cmd.SetStdout(stdout)
+	cmd.SetStderr(job.Output(entities.MessageCommandStderr))
+
+	logger.Infof("[command] start to run: %s", commandN.Script)
+	startAt := time.Now()
+	startedAt := startAt.UTC()
+	record.StartedAt = &startedAt
+	if err := store.Update(record); err != nil {
+		logger.Errorf("failed to update job record: %s", err)
+	}
+	if commandN.TTY {
+		if commandN.Rows != 0 && commandN.Cols != 0 {
+			job.ResizeTerminal(commandN.Rows, commandN.Cols)
+		}
+
+		err = runInTerminal(job, cmd, job.Stdin(), stdout)
+	} else if err = cmd.Start(); err == nil {
+		job.Start()
+		err = cmd.Wait()
+	}
+	// the command may exit by itself after SIGTERM of timeout
+	if err == nil && isTimeout.Load() {
+		err = fmt.Errorf("timeout after %s", timeout)
+	}
+	if err != nil {
+		if job.IsKilledByClose() {
+			logger.Infof("[command] killed by Close: %s", commandN.Script)
+			finish(entities.JobStatusFailure, &entities.Exit{
+				Code:     -1,
+				Reason:   entities.ExitReasonKilled,
+				Message:  "killed by connection close",
+				Duration: time.Since(startAt).Milliseconds(),
+			})
+			return
+		}
+
+		status := entities.JobStatusFailure
+		exit := &entities.Exit{
+			Code:     -1,
+			Reason:   entities.ExitReasonSpawnFailed,
+			Message:  err.Error(),
+			Duration: time.Since(startAt).Milliseconds(),
+		}
+		if code, signal, ok := getExitStatus(err); ok {
+			exit.Code = code
+			exit.Reason = entities.ExitReasonExited
+			if exit.Signal = signal; signal != "" {
+				exit.Reason = entities.ExitReasonSignaled
+			}
+		}
+		if isTimeout.Load() {
+			exit.Reason = entities.ExitReasonTimeout
+			exit.Message = fmt.Sprintf("timeout after %s", timeout)
+		} else if job.IsInterrupted() {
+			exit.Reason = entities.ExitReasonInterrupted
+			exit.Message = "interrupted by server shutdown"
+			status = entities.JobStatusInterrupted
+		} else if job.IsCancelled() {
+			exit.Reason = entities.ExitReasonKilled
+		}
+
+		logger.Errorf("[command] failed to run: %s (err: %v, exit code: %d, reason: %s)", commandN.Script, err, exit.Code, exit.Reason)
+		finish(status, exit)
+		return
+	}
+
+	logger.Infof("[command] succeed to run: %s", commandN.Script)
+	finish(entities.JobStatusSuccess, &entities.Exit{
+		Code:     0,
+		Reason:   entities.ExitReasonExited,
+		Duration: time.Since(startAt).Milliseconds(),
+	})
+
+	if tmpScriptFilepath != "" && fs.IsExist(tmpScriptFilepath) {
+		if err := fs.Remove(tmpScriptFilepath); err != nil {
+			panic(fmt.Errorf("failed to remove tmp script file: %s", err))
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// testViewer records the output and exit of job
+type testViewer struct {
+	mu     sync.Mutex
+	output bytes.Buffer
+	exit   *entities.Exit
+}
+
+func (v *testViewer) WriteOutput(flag byte, p []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.output.Write(p)
+	return nil
+}
+
+func (v *testViewer) WriteExit(exit *entities.Exit) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.exit = exit
+	return nil
+}
+
+func (v *testViewer) Output() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.output.String()
+}
+
+func (v *testViewer) Exit() *entities.Exit {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.exit
+}
+
+// newTestRunner returns the config and job manager to run jobs on host in temp dirs.
+func newTestRunner(t *testing.T) (*Config, *JobManager) {
+	t.Helper()
+
+	cfg := &Config{
+		Shell:       "sh",
+		WorkDir:     t.TempDir(),
+		MetadataDir: t.TempDir(),
+	}
+	registry, err := NewCommandRegistry(cfg)
+	if err != nil {
+		t.Fatalf("failed to create registry: %s", err)
+	}
+
+	return cfg, NewJobManager(cfg, newFileSystemStore(cfg.MetadataDir), nil, registry)
+}
+
+// runTestJob runs the command until exit.
+func runTestJob(cfg *Config, jobs *JobManager, command *entities.Command) *testViewer {
+	return runTestJobAs(cfg, jobs, "", command)
+}
+
+// runTestJobAs runs the command of client until exit.
+func runTestJobAs(cfg *Config, jobs *JobManager, clientID string, command *entities.Command) *testViewer {
+	viewer := &testViewer{}
+	job := NewJob("1")
+	job.ID = "default-id"
+	job.ClientID = clientID
+	job.CommandN = command
+	runJob(cfg, jobs, job, viewer, func(id string) {})
+	return viewer
+}
+
+func TestRunJobIdempotent(t *testing.T) {
+	cfg, jobs := newTestRunner(t)
+
+	// the marker file counts the runs
+	script := "echo run >> ../runs; echo hello"
+
+	first := runTestJob(cfg, jobs, &entities.Command{ID: "job-1", Script: script})
+	if first.Exit() == nil || first.Exit().Code != 0 || first.Output() != "hello\n" {
+		t.Fatalf("unexpected first run: %q %+v", first.Output(), first.Exit())
+	}
+
+	// the finished job replies its log and exit without running again
+	second := runTestJob(cfg, jobs, &entities.Command{ID: "job-1", Script: script})
+	if second.Exit() == nil || second.Exit().Code != 0 || second.Output() != "hello\n" {
+		t.Fatalf("unexpected reused run: %q %+v", second.Output(), second.Exit())
+	}
+
+	record, err := jobs.Store().Get("job-1")
+	if err != nil {
+		t.Fatalf("failed to get job: %s", err)
+	}
+	if record.Attempt != 1 {
+		t.Fatalf("expected attempt 1, got %d", record.Attempt)
+	}
+
+	// force runs a new attempt
+	third := runTestJob(cfg, jobs, &entities.Command{ID: "job-1", Script: script, Force: true})
+	if third.Exit() == nil || third.Exit().Code != 0 {
+		t.Fatalf("unexpected forced run: %+v", third.Exit())
+	}
+
+	record, err = jobs.Store().Get("job-1")
+	if err != nil {
+		t.Fatalf("failed to get job: %s", err)
+	}
+	if record.Attempt != 2 {
+		t.Fatalf("expected attempt 2, got %d", record.Attempt)
+	}
+
+	runs, _ := os.ReadFile(cfg.WorkDir + "/runs")
+	if strings.Count(string(runs), "run") != 2 {
+		t.Fatalf("expected the command runs twice, got %q", runs)
+	}
+}
+
+func TestRunJobOwner(t *testing.T) {
+	cfg, jobs := newTestRunner(t)
+
+	owned := runTestJobAs(cfg, jobs, "client-1", &entities.Command{ID: "job-1", Script: "echo hello"})
+	if owned.Exit() == nil || owned.Exit().Code != 0 {
+		t.Fatalf("unexpected run: %+v", owned.Exit())
+	}
+
+	testcases := []struct {
+		name     string
+		clientID string
+		force    bool
+		reason   string
+	}{
+		{name: "owner reuses", clientID: "client-1", reason: entities.ExitReasonExited},
+		{name: "other client reuses", clientID: "client-2", reason: entities.ExitReasonPermissionDenied},
+		{name: "other client forces", clientID: "client-2", force: true, reason: entities.ExitReasonPermissionDenied},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			viewer := runTestJobAs(cfg, jobs, tc.clientID, &entities.Command{ID: "job-1", Script: "echo again", Force: tc.force})
+			if viewer.Exit() == nil || viewer.Exit().Reason != tc.reason {
+				t.Fatalf("expected exit reason %q, got %+v", tc.reason, viewer.Exit())
+			}
+		})
+	}
+
+	record, err := jobs.Store().Get("job-1")
+	if err != nil {
+		t.Fatalf("failed to get job: %s", err)
+	}
+	if record.ClientID != "client-1" || record.Attempt != 1 {
+		t.Fatalf("expected the job of client-1 not run again, got %s attempt %d", record.ClientID, record.Attempt)
+	}
+}
+
+func TestRunJobFinish(t *testing.T) {
+	cfg, jobs := newTestRunner(t)
+
+	job := NewJob("1")
+	job.ID = "job-1"
+	job.CommandN = &entities.Command{Script: "echo hello"}
+	runJob(cfg, jobs, job, &testViewer{}, func(id string) {})
+
+	// the job is finished by runJob, the stdin is closed
+	if err := job.WriteStdin([]byte("x")); err != nil {
+		t.Fatalf("expected the stdin closed, got %s", err)
+	}
+	if job.runningCmd() != nil {
+		t.Fatal("expected the command stopped")
+	}
+}
+
+func TestRunJobReservedEnv(t *testing.T) {
+	cfg, jobs := newTestRunner(t)
+
+	viewer := runTestJob(cfg, jobs, &entities.Command{
+		Script:      "echo $GO_ZOOX_COMMAND_ID",
+		Environment: map[string]string{envCommandID: "other"},
+	})
+	if viewer.Exit() == nil || viewer.Exit().Code != 0 {
+		t.Fatalf("unexpected exit: %+v", viewer.Exit())
+	}
+	if output := strings.TrimSpace(viewer.Output()); !strings.HasPrefix(output, "go-zoox_caas_") {
+		t.Fatalf("expected the runner id is not overridden, got %q", output)
+	}
+}
+
+func TestRunJobInvalidID(t *testing.T) {
+	cfg, jobs := newTestRunner(t)
+
+	for _, id := range []string{"../escape", "a/b", "."} {
+		viewer := runTestJob(cfg, jobs, &entities.Command{ID: id, Script: "echo"})
+		if viewer.Exit() == nil || viewer.Exit().Reason != entities.ExitReasonInvalidRequest {
+			t.Fatalf("expected invalid request of id %q, got %+v", id, viewer.Exit())
+		}
+	}
+}
+
+func TestRunJobNegativeLimits(t *testing.T) {
+	cfg, jobs := newTestRunner(t)
+
+	testcases := map[string]*entities.Command{
+		"cpu":      {Script: "echo", CPU: -1},
+		"memory":   {Script: "echo", Memory: -1},
+		"timeout":  {Script: "echo", Timeout: -1},
+		"terminal": {Script: "echo", Rows: -1, Cols: 80},
+	}
+	for name, command := range testcases {
+		t.Run(name, func(t *testing.T) {
+			viewer := runTestJob(cfg, jobs, command)
+			if viewer.Exit() == nil || viewer.Exit().Reason != entities.ExitReasonInvalidRequest {
+				t.Fatalf("expected invalid request, got %+v", viewer.Exit())
+			}
+		})
+	}
+}
+
+func TestGetWorkDir(t *testing.T) {
+	cfg := &Config{WorkDir: "/work"}
+
+	testcases := map[int]string{
+		0: "/work/job-1",
+		1: "/work/job-1",
+		2: "/work/job-1.attempt-2",
+	}
+	for attempt, expected := range testcases {
+		if dir := cfg.GetWorkDir("job-1", attempt); dir != expected {
+			t.Fatalf("expected workdir %s of attempt %d, got %s", expected, attempt, dir)
+		}
+	}
+}
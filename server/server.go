@@ -1,8 +1,14 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/go-zoox/commands-as-a-service/entities"
 	"github.com/go-zoox/fs"
@@ -18,6 +24,7 @@ const DefaultShell = "sh"
 // Server is the server interface of caas
 type Server interface {
 	Run() error
+	Shutdown(ctx context.Context) error
 }
 
 // Config is the configuration of caas server
@@ -29,16 +36,74 @@ type Config struct {
 	Shell       string            `config:"shell"`
 	Environment map[string]string `config:"environment"`
 	Timeout     int64             `config:"timeout"`
+	// TimeoutGracePeriod is the seconds between SIGTERM and SIGKILL when timeout, 0 means kill immediately
+	TimeoutGracePeriod int64 `config:"timeout_grace_period"`
+	// TLS, the verified client certificate authenticates the client, whose subject is the identity
+	TLSCert                 string `config:"tls_cert"`
+	TLSKey                  string `config:"tls_key"`
+	TLSClientCA             string `config:"tls_client_ca"`
+	IsTLSClientCertRequired bool   `config:"is_tls_client_cert_required"`
 	// Auth
 	ClientID     string `config:"client_id"`
 	ClientSecret string `config:"client_secret"`
 	AuthService  string `config:"auth_service"`
+	// JWT auth, HS256 by JWTSecret, RS256 and ES256 by the keys of JWTJWKSFile
+	JWTSecret   string `config:"jwt_secret"`
+	JWTJWKSFile string `config:"jwt_jwks_file"`
+	JWTAudience string `config:"jwt_audience"`
+	JWTIssuer   string `config:"jwt_issuer"`
+	// PolicyFile is the json file of policy, which authorizes what each client may run
+	PolicyFile string `config:"policy_file"`
+	// TemplateFile is the json file of named command templates
+	TemplateFile string `config:"template_file"`
+	// ScriptAllowPatterns and ScriptDenyPatterns are the regexps of raw script, IsTemplateOnly denies all raw scripts
+	ScriptAllowPatterns []string `config:"script_allow_patterns"`
+	ScriptDenyPatterns  []string `config:"script_deny_patterns"`
+	IsTemplateOnly      bool     `config:"is_template_only"`
 	//
 	MetadataDir string `config:"metadatadir"`
+	// JobStore is the store of job metadata and log, options: filesystem (default, in MetadataDir), kv
+	JobStore string `config:"job_store"`
+	// JobStoreKVEngine is the engine of kv job store, options: filesystem (default), memory, redis
+	JobStoreKVEngine   string `config:"job_store_kv_engine"`
+	JobStoreKVDir      string `config:"job_store_kv_dir"`
+	JobStoreKVRedisURI string `config:"job_store_kv_redis_uri"`
+	// InstanceID is the id of this server, which is required by the shared job store (kv with redis),
+	// only its own interrupted jobs are recovered from the shared store. It must be stable across restarts.
+	InstanceID string `config:"instance_id"`
+	// MaxLogSize is the max bytes of output in the log of one job, the rest is dropped with truncation markers, 0 means unlimited
+	MaxLogSize int64 `config:"max_log_size"`
+	// IsCompressLog compresses the log with gzip when the job is finished
+	IsCompressLog bool `config:"is_compress_log"`
 	//
 	WorkDir string `config:"workdir"`
 	//
 	IsAutoCleanWorkDir bool `config:"is_auto_clean_workdir"`
+	//
+	// ShutdownTimeout is the seconds to wait for running jobs when receive SIGINT or SIGTERM
+	ShutdownTimeout int64 `config:"shutdown_timeout"`
+
+	// Retention (0 means unlimited), ages are in seconds
+	RetentionMaxAge       int64 `config:"retention_max_age"`
+	RetentionMaxAgeFailed int64 `config:"retention_max_age_failed"`
+	RetentionMaxJobs      int64 `config:"retention_max_jobs"`
+	RetentionMaxBytes     int64 `config:"retention_max_bytes"`
+	RetentionInterval     int64 `config:"retention_interval"`
+
+	// API
+	APIEnabled bool   `config:"api_enabled"`
+	APIPath    string `config:"api_path"`
+
+	// Queue
+	MaxConcurrentJobs int64 `config:"max_concurrent_jobs"`
+	QueueTimeout      int64 `config:"queue_timeout"`
+
+	// Quota (per client, 0 means unlimited)
+	MaxConnectionsPerClient   int64   `config:"max_connections_per_client"`
+	MaxJobsPerClient          int64   `config:"max_jobs_per_client"`
+	MaxJobsPerMinutePerClient int64   `config:"max_jobs_per_minute_per_client"`
+	MaxCPUPerClient           float64 `config:"max_cpu_per_client"`
+	MaxMemoryPerClient        int64   `config:"max_memory_per_client"`
 
 	// Terminal
 	TerminalEnabled     bool   `config:"terminal_enabled"`
@@ -49,106 +114,100 @@ type Config struct {
 	TerminalInitCommand string `config:"terminal_init_command"`
 }
 
-// CommandConfig is the configuration of caas command
+// CommandConfig is the configuration of caas command, the metadata is kept by JobStore
 type CommandConfig struct {
-	WorkDir   string
-	Script    *WriterFile
-	Log       *WriterFile
-	Env       *WriterFile
-	StartAt   *WriterFile
-	SucceedAt *WriterFile
-	FailedAt  *WriterFile
-	Status    *WriterFile
-	Error     *WriterFile
+	WorkDir string
 }
 
-func (c *Config) GetCommandConfig(id string, command *entities.Command) (*CommandConfig, error) {
-	var isNeedWrite bool
-	var oneMetadataDir string
+// IsAuthRequired returns whether the client must be authenticated.
+func (c *Config) IsAuthRequired() bool {
+	return c.ClientID != "" || c.ClientSecret != "" || c.AuthService != "" || c.IsJWTEnabled()
+}
 
-	if c.MetadataDir == "" {
-		c.MetadataDir = "/tmp/gzcaas/metadata"
-	}
+// IsJWTEnabled returns whether the jwt auth is enabled.
+func (c *Config) IsJWTEnabled() bool {
+	return c.JWTSecret != "" || c.JWTJWKSFile != ""
+}
 
-	if c.WorkDir == "" {
-		c.WorkDir = "/tmp/gzcaas/workdir"
+// GetTimeout returns the timeout of command, which is the minimum of client and server, 0 means no timeout.
+func (c *Config) GetTimeout(command *entities.Command) time.Duration {
+	timeout := c.Timeout
+	if command.Timeout > 0 && (timeout == 0 || command.Timeout < timeout) {
+		timeout = command.Timeout
 	}
 
-	oneMetadataDir = fmt.Sprintf("%s/%s", c.MetadataDir, id)
-	oneWorkDir := fmt.Sprintf("%s/%s", c.WorkDir, id)
-	isNeedWrite = true
+	return time.Duration(timeout) * time.Second
+}
 
-	if command.WorkDirBase != "" {
-		oneWorkDir = fmt.Sprintf("%s/%s", command.WorkDirBase, id)
-	}
+// IsSharedJobStore returns whether the job store may be shared by server instances, like kv with redis.
+func (c *Config) IsSharedJobStore() bool {
+	return c.JobStore == JobStoreKV && c.JobStoreKVEngine == "redis"
+}
 
-	if err := fs.Mkdirp(oneMetadataDir); err != nil {
-		return nil, fmt.Errorf("failed to create metadata dir: %s", err)
+// GetRetentionPolicy returns the retention policy of janitor.
+func (c *Config) GetRetentionPolicy() *RetentionPolicy {
+	return &RetentionPolicy{
+		MaxAge:       c.RetentionMaxAge,
+		MaxAgeFailed: c.RetentionMaxAgeFailed,
+		MaxJobs:      c.RetentionMaxJobs,
+		MaxBytes:     c.RetentionMaxBytes,
 	}
-	if err := fs.Mkdirp(oneWorkDir); err != nil {
-		return nil, fmt.Errorf("failed to create work dir: %s", err)
-	}
-
-	return &CommandConfig{
-		WorkDir:   oneWorkDir,
-		Script:    &WriterFile{Path: fmt.Sprintf("%s/script", oneMetadataDir), IsNeedWrite: isNeedWrite},
-		Log:       &WriterFile{Path: fmt.Sprintf("%s/log", oneMetadataDir), IsNeedWrite: isNeedWrite},
-		Env:       &WriterFile{Path: fmt.Sprintf("%s/env", oneMetadataDir), IsNeedWrite: isNeedWrite},
-		StartAt:   &WriterFile{Path: fmt.Sprintf("%s/start_at", oneMetadataDir), IsNeedWrite: isNeedWrite},
-		SucceedAt: &WriterFile{Path: fmt.Sprintf("%s/succeed_at", oneMetadataDir), IsNeedWrite: isNeedWrite},
-		FailedAt:  &WriterFile{Path: fmt.Sprintf("%s/failed_at", oneMetadataDir), IsNeedWrite: isNeedWrite},
-		Status:    &WriterFile{Path: fmt.Sprintf("%s/status", oneMetadataDir), IsNeedWrite: isNeedWrite},
-		Error:     &WriterFile{Path: fmt.Sprintf("%s/error", oneMetadataDir), IsNeedWrite: isNeedWrite},
-	}, nil
 }
 
-type WriterFile struct {
-	Path        string
-	IsNeedWrite bool
-	//
-	file *os.File
+// GetWorkDir returns the default workdir of job attempt, the first attempt is the dir of id.
+func (c *Config) GetWorkDir(id string, attempt int) string {
+	return fmt.Sprintf("%s/%s", c.WorkDir, getAttemptDirName(id, attempt))
 }
 
-func (w *WriterFile) Write(p []byte) (n int, err error) {
-	if !w.IsNeedWrite {
-		return len(p), nil
+// GetJobWorkDir returns the recorded workdir of job attempt, or the default workdir if it is not recorded.
+func (c *Config) GetJobWorkDir(job *entities.Job) string {
+	if job.WorkDir != "" {
+		return job.WorkDir
 	}
 
-	if w.file == nil {
-		if f, err := os.OpenFile(w.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
-			logger.Errorf("failed to open file: %s", err)
-		} else {
-			w.file = f
-		}
-	}
+	return c.GetWorkDir(job.ID, job.Attempt)
+}
 
-	if w.file != nil {
-		return w.file.Write(p)
+// GetCommandConfig returns the command config of job attempt, the work dir is created.
+func (c *Config) GetCommandConfig(id string, attempt int, command *entities.Command) (*CommandConfig, error) {
+	if c.WorkDir == "" {
+		c.WorkDir = "/tmp/gzcaas/workdir"
 	}
 
-	return len(p), nil
-}
+	oneWorkDir := c.GetWorkDir(id, attempt)
+	if command.WorkDirBase != "" {
+		oneWorkDir = fmt.Sprintf("%s/%s", command.WorkDirBase, getAttemptDirName(id, attempt))
+	}
 
-func (w *WriterFile) Close() error {
-	if w.file != nil {
-		return w.file.Close()
+	if err := fs.Mkdirp(oneWorkDir); err != nil {
+		return nil, fmt.Errorf("failed to create work dir: %s", err)
 	}
 
-	return nil
+	return &CommandConfig{
+		WorkDir: oneWorkDir,
+	}, nil
 }
 
-func (w *WriterFile) WriteString(content string) {
-	if !w.IsNeedWrite {
-		return
+// getAttemptDirName returns the dir name of job attempt, the later attempts are in new dirs.
+func getAttemptDirName(id string, attempt int) string {
+	if attempt <= 1 {
+		return id
 	}
 
-	if err := fs.WriteFile(w.Path, []byte(content)); err != nil {
-		logger.Errorf("failed to write file(%s): %s", w.Path, err)
-	}
+	return fmt.Sprintf("%s.attempt-%d", id, attempt)
 }
 
 type server struct {
 	cfg *Config
+	//
+	jobs    *JobManager
+	conns   *ConnManager
+	janitor *Janitor
+	//
+	err error
+	//
+	mu         sync.Mutex
+	httpServer *http.Server
 }
 
 // New creates a new caas server
@@ -165,12 +224,71 @@ func New(cfg *Config) Server {
 		cfg.Shell = DefaultShell
 	}
 
+	if cfg.MetadataDir == "" {
+		cfg.MetadataDir = "/tmp/gzcaas/metadata"
+	}
+
+	if cfg.WorkDir == "" {
+		cfg.WorkDir = "/tmp/gzcaas/workdir"
+	}
+
+	if cfg.APIPath == "" {
+		cfg.APIPath = "/api"
+	}
+
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = 30
+	}
+
+	if cfg.RetentionInterval == 0 {
+		cfg.RetentionInterval = 3600
+	}
+
+	if cfg.JobStoreKVDir == "" {
+		cfg.JobStoreKVDir = "/tmp/gzcaas/kv"
+	}
+
+	// the error of store, policy and commands is returned by Run
+	store, err := NewJobStore(cfg)
+	if err != nil {
+		err = fmt.Errorf("failed to create job store: %s", err)
+	}
+	policy, policyErr := LoadPolicy(cfg.PolicyFile)
+	if policyErr != nil && err == nil {
+		err = fmt.Errorf("failed to load policy: %s", policyErr)
+	}
+	commands, commandsErr := NewCommandRegistry(cfg)
+	if commandsErr != nil && err == nil {
+		err = fmt.Errorf("failed to load commands: %s", commandsErr)
+	}
+	jobs := NewJobManager(cfg, store, policy, commands)
 	return &server{
-		cfg: cfg,
+		cfg:     cfg,
+		jobs:    jobs,
+		conns:   NewConnManager(),
+		janitor: NewJanitor(cfg, jobs),
+		err:     err,
 	}
 }
 
 func (s *server) Run() error {
+	if s.err != nil {
+		return s.err
+	}
+
+	if s.cfg.IsJWTEnabled() {
+		if _, err := newJWTVerifier(s.cfg); err != nil {
+			return fmt.Errorf("failed to load jwt keys: %s", err)
+		}
+	}
+
+	if err := recoverJobs(s.cfg, s.jobs.Store()); err != nil {
+		return fmt.Errorf("failed to recover jobs: %s", err)
+	}
+
+	s.janitor.Start()
+	defer s.janitor.Stop()
+
 	app := defaults.Application()
 
 	wsServer, err := websocket.NewServer()
@@ -178,12 +296,25 @@ func (s *server) Run() error {
 		return err
 	}
 
-	createWsService(s.cfg)(wsServer)
+	createWsService(s.cfg, s.jobs, s.conns)(wsServer)
 
 	app.WebSocket(s.cfg.Path, func(opt *zoox.WebSocketOption) {
 		opt.Server = wsServer
+
+		// the identity of client certificate is passed to the connection by the context of upgrade request
+		opt.Middlewares = append(opt.Middlewares, func(ctx *zoox.Context) {
+			if identity := getCertIdentity(ctx.Request); identity != nil {
+				ctx.Request = ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), identityContextKey{}, identity))
+			}
+
+			ctx.Next()
+		})
 	})
 
+	if s.cfg.APIEnabled {
+		createAPIService(s.cfg, s.jobs, s.janitor)(app)
+	}
+
 	if s.cfg.TerminalEnabled {
 		server, err := terminal.Serve(&terminal.Config{
 			Shell:       s.cfg.TerminalShell,
@@ -223,5 +354,69 @@ func (s *server) Run() error {
 		})
 	}
 
-	return app.Run(fmt.Sprintf("0.0.0.0:%d", s.cfg.Port))
+	// graceful shutdown
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		sig, ok := <-signals
+		if !ok {
+			return
+		}
+
+		logger.Infof("receive signal: %s", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.ShutdownTimeout)*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			logger.Errorf("failed to shutdown: %s", err)
+		}
+	}()
+
+	// the http server is created instead of app.Run, which can not be shut down or verify optional client certificates.
+	// the new connections and requests are rejected when shutting down, while the running ones are drained.
+	httpServer := &http.Server{
+		Addr: fmt.Sprintf("0.0.0.0:%d", s.cfg.Port),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.jobs.IsClosed() {
+				w.Header().Set("Connection", "close")
+				http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+				return
+			}
+
+			app.ServeHTTP(w, r)
+		}),
+	}
+
+	if s.cfg.IsTLSEnabled() {
+		tlsCfg, err := newTLSConfig(s.cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create tls config: %s", err)
+		}
+		httpServer.TLSConfig = tlsCfg
+	}
+
+	// the shutdown before serve stops the server, see Shutdown
+	s.mu.Lock()
+	if s.jobs.IsClosed() {
+		s.mu.Unlock()
+		return nil
+	}
+	s.httpServer = httpServer
+	s.mu.Unlock()
+
+	if httpServer.TLSConfig != nil {
+		logger.Infof("server started at %s (tls)", httpServer.Addr)
+		if err := httpServer.ListenAndServeTLS(s.cfg.TLSCert, s.cfg.TLSKey); err != nil && err != http.ErrServerClosed {
+			return err
+		}
+
+		return nil
+	}
+
+	logger.Infof("server started at %s", httpServer.Addr)
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
 }
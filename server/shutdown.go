@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+	"github.com/go-zoox/logger"
+)
+
+// Shutdown stops accepting new connections and commands, notifies the clients, and waits for the running jobs until ctx is done,
+// the rest jobs are cancelled and recorded as interrupted.
+func (s *server) Shutdown(ctx context.Context) error {
+	logger.Infof("[shutdown] start to shutdown")
+	// the new requests are rejected once the jobs are closed, see Run
+	s.jobs.Close()
+	s.janitor.Stop()
+
+	s.mu.Lock()
+	httpServer := s.httpServer
+	s.mu.Unlock()
+	if httpServer != nil {
+		httpServer.SetKeepAlivesEnabled(false)
+	}
+
+	for _, conn := range s.conns.List() {
+		conn.WriteTextMessage(entities.EncodeFrame(entities.MessageServerShutdown, "", []byte("server is shutting down")))
+	}
+
+	// the queued jobs will not have a chance to run
+	for _, job := range s.jobs.List() {
+		if job.IsQueued() {
+			job.Interrupt()
+		}
+	}
+
+	if err := s.jobs.Wait(ctx); err != nil {
+		jobs := s.jobs.List()
+		logger.Infof("[shutdown] interrupt %d running jobs", len(jobs))
+		for _, job := range jobs {
+			if err := job.Interrupt(); err != nil {
+				logger.Errorf("[shutdown] failed to interrupt job(%s): %s", job.ID, err)
+			}
+		}
+
+		// wait a moment for the interrupted jobs to record their status
+		waitCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.jobs.Wait(waitCtx)
+	}
+
+	for _, conn := range s.conns.List() {
+		conn.Close()
+	}
+
+	if httpServer != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			return err
+		}
+	}
+
+	logger.Infof("[shutdown] done")
+	return nil
+}
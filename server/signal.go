@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// envCommandID is the environment of runner id, which is injected into the command by go-zoox/command
+const envCommandID = "GO_ZOOX_COMMAND_ID"
+
+// terminalSignals is the control characters of signals in terminal
+var terminalSignals = map[string][]byte{
+	"SIGINT":  {0x03},
+	"SIGQUIT": {0x1c},
+	"SIGTSTP": {0x1a},
+}
+
+// Terminate sends SIGTERM to the command, and kills it if it is still running after the grace period.
+// grace <= 0 means kill immediately.
+func (j *Job) Terminate(grace time.Duration) error {
+	if grace <= 0 {
+		return j.kill()
+	}
+
+	if err := j.Signal("SIGTERM"); err != nil {
+		return j.kill()
+	}
+
+	go func() {
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+
+		select {
+		case <-j.done:
+		case <-timer.C:
+			j.kill()
+		}
+	}()
+
+	return nil
+}
+
+// Signal sends the signal to the running command.
+func (j *Job) Signal(name string) error {
+	sig, ok := entities.Signals[name]
+	if !ok {
+		return fmt.Errorf("unsupported signal: %s", name)
+	}
+
+	cmd := j.runningCmd()
+	if cmd == nil || j.CommandN == nil {
+		return fmt.Errorf("no running command")
+	}
+
+	// tty: send the control character like ctrl-c, which is the same as keyboard
+	j.terminalMu.Lock()
+	term := j.terminal
+	j.terminalMu.Unlock()
+	if term != nil {
+		if ch, ok := terminalSignals[name]; ok {
+			_, err := term.Write(ch)
+			return err
+		}
+	}
+
+	if j.RunnerID != "" {
+		processes, err := findProcesses(j.RunnerID)
+		if err == nil && len(processes) != 0 {
+			for _, process := range processes {
+				if err := process.Signal(sig); err != nil {
+					return fmt.Errorf("failed to send %s to process(%d): %s", name, process.Pid, err)
+				}
+			}
+
+			return nil
+		}
+	}
+
+	// other engines can only be cancelled
+	switch sig {
+	case syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL:
+		return cmd.Cancel()
+	default:
+		return fmt.Errorf("signal %s is not supported by engine %s", name, j.CommandN.Engine)
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// sseViewer writes the output and exit of a job as server-sent events,
+// the event id is the offset of log, which is used to resume by Last-Event-ID.
+//
+// The output over maxLogSize is not in log, so the offset stops at maxLogSize (0 means unlimited) like the log.
+type sseViewer struct {
+	mu         sync.Mutex
+	writer     io.Writer
+	offset     int64
+	maxLogSize int64
+	closed     bool
+	done       chan struct{}
+}
+
+func newSSEViewer(writer io.Writer, offset int64, maxLogSize int64) *sseViewer {
+	return &sseViewer{
+		writer:     writer,
+		offset:     offset,
+		maxLogSize: maxLogSize,
+		done:       make(chan struct{}),
+	}
+}
+
+func (v *sseViewer) WriteOutput(flag byte, p []byte) error {
+	event := "stdout"
+	if flag == entities.MessageCommandStderr {
+		event = "stderr"
+	}
+
+	data, err := json.Marshal(string(p))
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.offset += int64(len(p))
+	if v.maxLogSize > 0 && v.offset > v.maxLogSize {
+		v.offset = v.maxLogSize
+	}
+	return v.write(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", v.offset, event, data))
+}
+
+func (v *sseViewer) WriteExit(exit *entities.Exit) error {
+	data, err := json.Marshal(exit)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	err = v.write(fmt.Sprintf("event: exit\ndata: %s\n\n", data))
+	if !v.closed {
+		v.closed = true
+		close(v.done)
+	}
+	return err
+}
+
+// Ping writes a comment to keep the connection alive through proxies.
+func (v *sseViewer) Ping() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.write(": ping\n\n")
+}
+
+// Close stops writing, the viewer is removed from job by the next write error.
+func (v *sseViewer) Close() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if !v.closed {
+		v.closed = true
+		close(v.done)
+	}
+}
+
+// Done is closed when the exit is written or the viewer is closed.
+func (v *sseViewer) Done() <-chan struct{} {
+	return v.done
+}
+
+func (v *sseViewer) write(message string) error {
+	if v.closed {
+		return io.ErrClosedPipe
+	}
+
+	if _, err := io.WriteString(v.writer, message); err != nil {
+		return err
+	}
+	if flusher, ok := v.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+func TestSSEViewerEvents(t *testing.T) {
+	buf := &bytes.Buffer{}
+	viewer := newSSEViewer(buf, 4, 0)
+
+	viewer.WriteOutput(entities.MessageCommandStdout, []byte("hello "))
+	viewer.WriteOutput(entities.MessageCommandStderr, []byte("world\n"))
+	if err := viewer.WriteExit(&entities.Exit{Code: 1}); err != nil {
+		t.Fatalf("failed to write exit: %s", err)
+	}
+
+	// the event id is the offset of log after the output
+	expected := "id: 10\nevent: stdout\ndata: \"hello \"\n\n" +
+		"id: 16\nevent: stderr\ndata: \"world\\n\"\n\n" +
+		"event: exit\ndata: {\"code\":1"
+	if !strings.HasPrefix(buf.String(), expected) {
+		t.Fatalf("expected events %q, got %q", expected, buf.String())
+	}
+
+	select {
+	case <-viewer.Done():
+	default:
+		t.Fatal("expected done after exit")
+	}
+
+	// the viewer stops writing after exit
+	if err := viewer.WriteOutput(entities.MessageCommandStdout, []byte("more")); err == nil {
+		t.Fatal("expected error after exit")
+	}
+}
+
+func TestSSEViewerClose(t *testing.T) {
+	buf := &bytes.Buffer{}
+	viewer := newSSEViewer(buf, 0, 0)
+
+	viewer.Close()
+	viewer.Close()
+
+	if err := viewer.Ping(); err == nil {
+		t.Fatal("expected error after close")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing written, got %q", buf.String())
+	}
+}
+
+func TestSSEViewerOffset(t *testing.T) {
+	testcases := []struct {
+		name       string
+		offset     int64
+		maxLogSize int64
+		ids        []string
+	}{
+		{"unlimited", 0, 0, []string{"id: 6\n", "id: 13\n"}},
+		{"resumed", 4, 0, []string{"id: 10\n", "id: 17\n"}},
+		// the output over max log size is not in log, so the id stops at max size
+		{"truncated", 0, 10, []string{"id: 6\n", "id: 10\n"}},
+		{"resumed at max size", 10, 10, []string{"id: 10\n", "id: 10\n"}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			viewer := newSSEViewer(buf, tc.offset, tc.maxLogSize)
+
+			for i, p := range []string{"hello ", "world!\n"} {
+				buf.Reset()
+				if err := viewer.WriteOutput(entities.MessageCommandStdout, []byte(p)); err != nil {
+					t.Fatalf("failed to write output: %s", err)
+				}
+
+				if !strings.HasPrefix(buf.String(), tc.ids[i]) {
+					t.Fatalf("expected event %q, got %q", tc.ids[i], buf.String())
+				}
+			}
+		})
+	}
+}
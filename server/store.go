@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// JobStoreFileSystem stores the job in metadata dir, one dir per job
+const JobStoreFileSystem = "filesystem"
+
+// JobStoreKV stores the job in key-value store
+const JobStoreKV = "kv"
+
+// ErrJobNotFound is returned when the job is not found in store
+var ErrJobNotFound = fmt.Errorf("job not found")
+
+// JobStore is the store of job metadata and log
+type JobStore interface {
+	// Create creates the job record, the old record and log with the same id are archived by its attempt
+	Create(job *entities.Job) error
+	// Update updates the job record, like status and finished time
+	Update(job *entities.Job) error
+	// Get returns the job record, or ErrJobNotFound
+	Get(id string) (*entities.Job, error)
+	// List returns all the job records
+	List() ([]*entities.Job, error)
+	// Delete deletes the job record and log
+	Delete(id string) error
+	// AppendLog appends the output to the log of job
+	AppendLog(id string, p []byte) error
+	// ReadLog reads the log of job from offset
+	ReadLog(id string, offset int64) (io.ReadCloser, error)
+	// LogSize returns the size of log in bytes
+	LogSize(id string) int64
+	// CloseLog closes the log of finished job, which is compressed with gzip if compress
+	CloseLog(id string, compress bool) error
+	// GetAttempt returns the record of archived attempt, or ErrJobNotFound
+	GetAttempt(id string, attempt int) (*entities.Job, error)
+	// ReadAttemptLog reads the log of archived attempt from offset
+	ReadAttemptLog(id string, attempt int, offset int64) (io.ReadCloser, error)
+}
+
+// getArchivedAttempt returns the attempt of record to archive, the first attempt is 0 or 1.
+func getArchivedAttempt(job *entities.Job) int {
+	if job.Attempt <= 1 {
+		return 1
+	}
+
+	return job.Attempt
+}
+
+// NewJobStore creates the job store by config.
+func NewJobStore(cfg *Config) (JobStore, error) {
+	switch cfg.JobStore {
+	case "", JobStoreFileSystem:
+		return newFileSystemStore(cfg.MetadataDir), nil
+	case JobStoreKV:
+		// the interrupted jobs of shared store are recovered by their instance, which must be stable across restarts
+		if cfg.IsSharedJobStore() && cfg.InstanceID == "" {
+			return nil, fmt.Errorf("instance_id is required by the shared job store")
+		}
+
+		return newKVStore(cfg)
+	default:
+		return nil, fmt.Errorf("unknown job store: %s", cfg.JobStore)
+	}
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+	"github.com/go-zoox/fs"
+)
+
+// fileSystemStore stores the job in metadata dir, one dir per job with the record (job.json) and log (or log.gz if compressed).
+// The previous attempts are archived in attempts/<attempt> of the job dir with the same files.
+// The legacy dirs with separate files (script, env, start_at, succeed_at, failed_at, status, error) are readable.
+type fileSystemStore struct {
+	dir string
+	//
+	mu   sync.Mutex
+	logs map[string]*os.File
+}
+
+// legacyFiles is the metadata files of legacy layout
+var legacyFiles = []string{"script", "env", "start_at", "succeed_at", "failed_at", "status", "error"}
+
+func newFileSystemStore(dir string) *fileSystemStore {
+	return &fileSystemStore{
+		dir:  dir,
+		logs: map[string]*os.File{},
+	}
+}
+
+func (s *fileSystemStore) Create(job *entities.Job) error {
+	s.closeLog(job.ID)
+
+	if last, err := s.Get(job.ID); err == nil && last.Attempt != job.Attempt {
+		if err := s.archive(last); err != nil {
+			return err
+		}
+	}
+
+	dir := s.getDir(job.ID)
+	if err := fs.Mkdirp(dir); err != nil {
+		return fmt.Errorf("failed to create metadata dir: %s", err)
+	}
+
+	for _, name := range append([]string{"log", "log.gz"}, legacyFiles...) {
+		if path := s.getPath(job.ID, name); fs.IsExist(path) {
+			if err := fs.Remove(path); err != nil {
+				return fmt.Errorf("failed to reset %s: %s", name, err)
+			}
+		}
+	}
+
+	return s.Update(job)
+}
+
+// Update writes the record to a temporary file and renames it, so that the record is never partially written.
+func (s *fileSystemStore) Update(job *entities.Job) error {
+	content, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode job(%s): %s", job.ID, err)
+	}
+
+	path := s.getPath(job.ID, "job.json")
+	tmpPath := fmt.Sprintf("%s.%d.tmp", path, time.Now().UnixNano())
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return fmt.Errorf("failed to write job(%s): %s", job.ID, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write job(%s): %s", job.ID, err)
+	}
+
+	if isJobFinished(job.Status) {
+		s.closeLog(job.ID)
+	}
+
+	return nil
+}
+
+func (s *fileSystemStore) Get(id string) (*entities.Job, error) {
+	if !fs.IsDir(s.getDir(id)) {
+		return nil, ErrJobNotFound
+	}
+
+	content, err := os.ReadFile(s.getPath(id, "job.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.getLegacy(id), nil
+		}
+
+		return nil, fmt.Errorf("failed to read job(%s): %s", id, err)
+	}
+
+	job := &entities.Job{}
+	if err := json.Unmarshal(content, job); err != nil {
+		return nil, fmt.Errorf("failed to decode job(%s): %s", id, err)
+	}
+	job.LogSize = s.LogSize(id)
+
+	return job, nil
+}
+
+// getLegacy reads the job of legacy layout, the local times are converted to UTC.
+func (s *fileSystemStore) getLegacy(id string) *entities.Job {
+	script := s.read(id, "script")
+	job := &entities.Job{
+		ID:         id,
+		Script:     script,
+		ScriptHash: entities.HashScript(script),
+		EnvKeys:    []string{},
+		Status:     s.read(id, "status"),
+		LogSize:    s.LogSize(id),
+	}
+
+	if env := s.read(id, "env"); env != "" {
+		for _, line := range strings.Split(env, "\n") {
+			job.EnvKeys = append(job.EnvKeys, strings.SplitN(line, "=", 2)[0])
+		}
+		sort.Strings(job.EnvKeys)
+	}
+
+	if startedAt, ok := parseLegacyTime(s.read(id, "start_at")); ok {
+		job.CreatedAt = startedAt
+		job.StartedAt = &startedAt
+	} else if info, err := os.Stat(s.getDir(id)); err == nil {
+		job.CreatedAt = info.ModTime().UTC()
+	}
+
+	switch job.Status {
+	case entities.JobStatusSuccess:
+		job.Exit = &entities.Exit{Code: 0, Reason: entities.ExitReasonExited}
+		if finishedAt, ok := parseLegacyTime(s.read(id, "succeed_at")); ok {
+			job.FinishedAt = &finishedAt
+		}
+	case entities.JobStatusFailure, entities.JobStatusInterrupted:
+		// the exit code is not recorded in legacy layout
+		job.Exit = &entities.Exit{Code: 1, Reason: entities.ExitReasonExited, Message: s.read(id, "error")}
+		if job.Status == entities.JobStatusInterrupted {
+			job.Exit.Code = -1
+			job.Exit.Reason = entities.ExitReasonInterrupted
+		}
+		if finishedAt, ok := parseLegacyTime(s.read(id, "failed_at")); ok {
+			job.FinishedAt = &finishedAt
+		}
+	}
+
+	if job.StartedAt != nil && job.FinishedAt != nil && job.Exit != nil {
+		job.Exit.Duration = job.FinishedAt.Sub(*job.StartedAt).Milliseconds()
+	}
+
+	return job
+}
+
+// parseLegacyTime parses the local time in YYYY-MM-DD HH:mm:ss, returns the time in UTC.
+func parseLegacyTime(value string) (time.Time, bool) {
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t.UTC(), true
+}
+
+func (s *fileSystemStore) List() ([]*entities.Job, error) {
+	if !fs.IsDir(s.dir) {
+		return []*entities.Job{}, nil
+	}
+
+	infos, err := fs.ListDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list metadata dir: %s", err)
+	}
+
+	jobs := []*entities.Job{}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+
+		job, err := s.Get(info.Name())
+		if err != nil {
+			continue
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+func (s *fileSystemStore) Delete(id string) error {
+	s.closeLog(id)
+
+	if err := fs.Remove(s.getDir(id)); err != nil {
+		return fmt.Errorf("failed to remove metadata dir: %s", err)
+	}
+
+	return nil
+}
+
+func (s *fileSystemStore) AppendLog(id string, p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.logs[id]
+	if !ok {
+		var err error
+		if f, err = os.OpenFile(s.getPath(id, "log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return fmt.Errorf("failed to open log: %s", err)
+		}
+
+		s.logs[id] = f
+	}
+
+	_, err := f.Write(p)
+	return err
+}
+
+func (s *fileSystemStore) ReadLog(id string, offset int64) (io.ReadCloser, error) {
+	return readLogFile(s.getDir(id), offset)
+}
+
+func (s *fileSystemStore) GetAttempt(id string, attempt int) (*entities.Job, error) {
+	dir := s.getAttemptDir(id, attempt)
+	content, err := os.ReadFile(fmt.Sprintf("%s/job.json", dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrJobNotFound
+		}
+
+		return nil, fmt.Errorf("failed to read job(%s) attempt(%d): %s", id, attempt, err)
+	}
+
+	job := &entities.Job{}
+	if err := json.Unmarshal(content, job); err != nil {
+		return nil, fmt.Errorf("failed to decode job(%s) attempt(%d): %s", id, attempt, err)
+	}
+	job.LogSize = getLogFileSize(dir)
+
+	return job, nil
+}
+
+func (s *fileSystemStore) ReadAttemptLog(id string, attempt int, offset int64) (io.ReadCloser, error) {
+	return readLogFile(s.getAttemptDir(id, attempt), offset)
+}
+
+// archive moves the record and log of the last attempt to its attempt dir.
+func (s *fileSystemStore) archive(last *entities.Job) error {
+	dir := s.getAttemptDir(last.ID, getArchivedAttempt(last))
+	if err := fs.Mkdirp(dir); err != nil {
+		return fmt.Errorf("failed to create attempt dir: %s", err)
+	}
+
+	for _, name := range []string{"log", "log.gz"} {
+		if path := s.getPath(last.ID, name); fs.IsExist(path) {
+			if err := os.Rename(path, fmt.Sprintf("%s/%s", dir, name)); err != nil {
+				return fmt.Errorf("failed to archive %s: %s", name, err)
+			}
+		}
+	}
+
+	content, err := json.MarshalIndent(last, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode job(%s): %s", last.ID, err)
+	}
+	if err := os.WriteFile(fmt.Sprintf("%s/job.json", dir), content, 0644); err != nil {
+		return fmt.Errorf("failed to archive job(%s): %s", last.ID, err)
+	}
+
+	return nil
+}
+
+// readLogFile reads the log (or log.gz if compressed) in dir from offset.
+func readLogFile(dir string, offset int64) (io.ReadCloser, error) {
+	if path := fmt.Sprintf("%s/log.gz", dir); fs.IsExist(path) {
+		return readGzipLog(path, offset)
+	}
+
+	f, err := os.Open(fmt.Sprintf("%s/log", dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return io.NopCloser(bytes.NewReader(nil)), nil
+		}
+
+		return nil, err
+	}
+
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// LogSize returns the size of log on disk, which is the compressed size if compressed.
+func (s *fileSystemStore) LogSize(id string) int64 {
+	return getLogFileSize(s.getDir(id))
+}
+
+// getLogFileSize returns the size of log (or log.gz if compressed) in dir.
+func getLogFileSize(dir string) int64 {
+	info, err := os.Stat(fmt.Sprintf("%s/log", dir))
+	if err != nil {
+		if info, err = os.Stat(fmt.Sprintf("%s/log.gz", dir)); err != nil {
+			return 0
+		}
+	}
+
+	return info.Size()
+}
+
+// CloseLog closes the log, and compresses it to log.gz if compress, the plain log is removed after compressed.
+func (s *fileSystemStore) CloseLog(id string, compress bool) error {
+	s.closeLog(id)
+
+	path := s.getPath(id, "log")
+	if !compress || !fs.IsExist(path) {
+		return nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open log: %s", err)
+	}
+	defer src.Close()
+
+	gzPath := s.getPath(id, "log.gz")
+	tmpPath := fmt.Sprintf("%s.%d.tmp", gzPath, time.Now().UnixNano())
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create compressed log: %s", err)
+	}
+
+	writer := gzip.NewWriter(dst)
+	_, err = io.Copy(writer, src)
+	if err == nil {
+		err = writer.Close()
+	}
+	if errx := dst.Close(); err == nil {
+		err = errx
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, gzPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to compress log: %s", err)
+	}
+
+	return os.Remove(path)
+}
+
+func (s *fileSystemStore) closeLog(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.logs[id]; ok {
+		f.Close()
+		delete(s.logs, id)
+	}
+}
+
+func (s *fileSystemStore) getDir(id string) string {
+	return fmt.Sprintf("%s/%s", s.dir, id)
+}
+
+func (s *fileSystemStore) getAttemptDir(id string, attempt int) string {
+	return fmt.Sprintf("%s/%s/attempts/%d", s.dir, id, attempt)
+}
+
+func (s *fileSystemStore) getPath(id, name string) string {
+	return fmt.Sprintf("%s/%s/%s", s.dir, id, name)
+}
+
+func (s *fileSystemStore) read(id, name string) string {
+	content, _ := fs.ReadFileAsString(s.getPath(id, name))
+	return strings.TrimSpace(content)
+}
+
+// readGzipLog reads the compressed log from the offset of uncompressed content.
+func readGzipLog(path string, offset int64) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read compressed log: %s", err)
+	}
+
+	if offset > 0 {
+		if _, err := io.CopyN(io.Discard, reader, offset); err != nil && err != io.EOF {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return &gzipLogReader{Reader: reader, file: f}, nil
+}
+
+// gzipLogReader closes the file of compressed log
+type gzipLogReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *gzipLogReader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// createTestLegacyJob creates the job dir of legacy layout with the files.
+func createTestLegacyJob(t *testing.T, dir, id string, files map[string]string) {
+	t.Helper()
+
+	if err := os.MkdirAll(fmt.Sprintf("%s/%s", dir, id), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(fmt.Sprintf("%s/%s/%s", dir, id, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileSystemStoreLegacy(t *testing.T) {
+	dir := t.TempDir()
+	store := newFileSystemStore(dir)
+
+	startedAt := time.Date(2024, 1, 1, 8, 0, 0, 0, time.Local)
+	finishedAt := startedAt.Add(3 * time.Second)
+	createTestLegacyJob(t, dir, "failed", map[string]string{
+		"script":    "exit 2",
+		"env":       "B=2\nA=1",
+		"start_at":  startedAt.Format("2006-01-02 15:04:05") + "\n",
+		"failed_at": finishedAt.Format("2006-01-02 15:04:05"),
+		"status":    entities.JobStatusFailure,
+		"error":     "exit status 2",
+		"log":       "output\n",
+	})
+	createTestLegacyJob(t, dir, "succeed", map[string]string{
+		"script":     "echo",
+		"start_at":   startedAt.Format("2006-01-02 15:04:05"),
+		"succeed_at": finishedAt.Format("2006-01-02 15:04:05"),
+		"status":     entities.JobStatusSuccess,
+	})
+	createTestLegacyJob(t, dir, "running", map[string]string{
+		"script": "sleep 1000",
+	})
+
+	job, err := store.Get("failed")
+	if err != nil {
+		t.Fatalf("failed to get legacy job: %s", err)
+	}
+	if job.Script != "exit 2" || job.ScriptHash != entities.HashScript("exit 2") || strings.Join(job.EnvKeys, ",") != "A,B" {
+		t.Fatalf("unexpected script or env keys of legacy job: %+v", job)
+	}
+	if !job.CreatedAt.Equal(startedAt) || job.CreatedAt.Location() != time.UTC {
+		t.Fatalf("expected created at %s in UTC, got %s", startedAt.UTC(), job.CreatedAt)
+	}
+	if job.FinishedAt == nil || !job.FinishedAt.Equal(finishedAt) || job.Exit.Duration != 3000 {
+		t.Fatalf("unexpected finished at %v or duration %d", job.FinishedAt, job.Exit.Duration)
+	}
+
+	testcases := []struct {
+		id     string
+		status string
+		// exit is nil if the job is not finished
+		exit *entities.Exit
+		log  string
+	}{
+		{
+			id:     "failed",
+			status: entities.JobStatusFailure,
+			exit:   &entities.Exit{Code: 1, Reason: entities.ExitReasonExited, Message: "exit status 2"},
+			log:    "output\n",
+		},
+		{
+			id:     "succeed",
+			status: entities.JobStatusSuccess,
+			exit:   &entities.Exit{Code: 0, Reason: entities.ExitReasonExited},
+		},
+		// the legacy job without status was running, which is recovered as interrupted
+		{
+			id: "running",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.id, func(t *testing.T) {
+			job, err := store.Get(tc.id)
+			if err != nil {
+				t.Fatalf("failed to get legacy job: %s", err)
+			}
+
+			if tc.exit == nil {
+				if isJobFinished(job.Status) || job.Exit != nil {
+					t.Fatalf("expected unfinished legacy job, got %+v", job)
+				}
+			} else if job.Status != tc.status || job.Exit == nil || job.Exit.Code != tc.exit.Code || job.Exit.Reason != tc.exit.Reason || job.Exit.Message != tc.exit.Message {
+				t.Fatalf("expected status %s and exit %+v, got %s %+v", tc.status, tc.exit, job.Status, job.Exit)
+			}
+
+			// the legacy log is the raw output
+			if job.LogSize != int64(len(tc.log)) {
+				t.Fatalf("expected log size %d, got %d", len(tc.log), job.LogSize)
+			}
+			log := &strings.Builder{}
+			err = readLogEntries(store, job, 0, -1, func(entry *entities.LogEntry, data []byte) error {
+				log.Write(data)
+				return nil
+			})
+			if err != nil || log.String() != tc.log {
+				t.Fatalf("expected log %q, got %q (%v)", tc.log, log.String(), err)
+			}
+		})
+	}
+
+	jobs, err := store.List()
+	if err != nil || len(jobs) != 3 {
+		t.Fatalf("expected 3 legacy jobs, got %d (%v)", len(jobs), err)
+	}
+}
+
+func TestFileSystemStoreCreateResetsLegacy(t *testing.T) {
+	dir := t.TempDir()
+	store := newFileSystemStore(dir)
+	createTestLegacyJob(t, dir, "job-1", map[string]string{
+		"script": "echo old",
+		"status": entities.JobStatusSuccess,
+		"log":    "old\n",
+	})
+
+	if err := store.Create(&entities.Job{ID: "job-1", Script: "echo new", Status: entities.JobStatusRunning}); err != nil {
+		t.Fatalf("failed to create job: %s", err)
+	}
+
+	for _, name := range []string{"script", "status", "log"} {
+		if _, err := os.Stat(fmt.Sprintf("%s/job-1/%s", dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("expected legacy file %s removed, got %v", name, err)
+		}
+	}
+
+	job, err := store.Get("job-1")
+	if err != nil {
+		t.Fatalf("failed to get job: %s", err)
+	}
+	if job.Script != "echo new" || job.Status != entities.JobStatusRunning {
+		t.Fatalf("expected the new record, got %+v", job)
+	}
+}
@@ -0,0 +1,615 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+	"github.com/go-zoox/kv"
+	kvfs "github.com/go-zoox/kv/fs"
+	kvredis "github.com/go-zoox/kv/redis"
+	"github.com/go-zoox/logger"
+)
+
+const kvJobPrefix = "job:"
+
+const kvLogPrefix = "log:"
+
+const kvLogMetaPrefix = "logmeta:"
+
+const kvAttemptPrefix = "attempt:"
+
+// kvJobIndexKey is the key of job ids, which is listed instead of scanning all keys
+const kvJobIndexKey = "index:jobs"
+
+// kvLogChunkSize is the size of buffered log which is flushed as a chunk
+const kvLogChunkSize = 64 * 1024
+
+// kvLogFlushInterval is the max delay of the buffered log before it is flushed, so that other instances see the recent output
+const kvLogFlushInterval = time.Second
+
+// kvStore stores the job in key-value store, the record is json and the log is stored in chunks.
+// The values are stored as string, which is supported by all kv engines.
+// The job ids are kept in an index key, so that listing does not scan the keys of log chunks.
+//
+// The log is buffered in memory and flushed as a chunk by size or by a timer, the count and size of chunks
+// are kept in a small meta key, so that the record is not rewritten by every output.
+// The chunks are immutable once written, so they are read without lock.
+//
+// The previous attempt is archived with its log meta, the chunks of next attempt are written after its chunks.
+type kvStore struct {
+	kv kv.KV
+	//
+	mu   sync.Mutex
+	logs map[string]*kvLog
+	//
+	indexMu sync.Mutex
+}
+
+// kvRecord is the record of job in kv
+type kvRecord struct {
+	Job *entities.Job `json:"job"`
+}
+
+// kvAttemptRecord is the record of archived attempt in kv
+type kvAttemptRecord struct {
+	Job *entities.Job `json:"job"`
+	Log *kvLogMeta    `json:"log"`
+}
+
+// kvLogMeta is the meta of log chunks
+type kvLogMeta struct {
+	// First is the index of first chunk
+	First  int   `json:"first,omitempty"`
+	Chunks int   `json:"chunks"`
+	Size   int64 `json:"size"`
+	// Compressed is whether the log is compressed with gzip in one chunk
+	Compressed bool `json:"compressed,omitempty"`
+}
+
+// kvLog is the log of job being appended
+type kvLog struct {
+	mu   sync.Mutex
+	meta *kvLogMeta
+	buf  bytes.Buffer
+	// timer flushes the buffer after kvLogFlushInterval, it is set while the buffer is not empty
+	timer *time.Timer
+}
+
+func newKVStore(cfg *Config) (*kvStore, error) {
+	kvCfg := &kv.Config{
+		Engine: cfg.JobStoreKVEngine,
+	}
+	switch cfg.JobStoreKVEngine {
+	case "", "filesystem":
+		kvCfg.Engine = "filesystem"
+		kvCfg.Config = &kvfs.FileSystemOptions{
+			Dir: cfg.JobStoreKVDir,
+		}
+	case "redis":
+		kvCfg.Config = &kvredis.Config{
+			URI:    cfg.JobStoreKVRedisURI,
+			Prefix: "gzcaas:",
+		}
+	}
+
+	core, err := kv.New(kvCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kv(%s): %s", kvCfg.Engine, err)
+	}
+
+	return &kvStore{
+		kv:   core,
+		logs: map[string]*kvLog{},
+	}, nil
+}
+
+func (s *kvStore) Create(job *entities.Job) error {
+	if err := s.flushLog(job.ID, true); err != nil {
+		return err
+	}
+
+	if last, err := s.get(job.ID); err == nil && last.Attempt != job.Attempt {
+		if err := s.archive(last); err != nil {
+			return err
+		}
+	} else {
+		s.deleteLog(job.ID)
+	}
+
+	if err := s.set(job); err != nil {
+		return err
+	}
+
+	return s.updateIndex(job.ID, true)
+}
+
+func (s *kvStore) Update(job *entities.Job) error {
+	if _, err := s.get(job.ID); err != nil {
+		return err
+	}
+
+	if isJobFinished(job.Status) {
+		if err := s.flushLog(job.ID, true); err != nil {
+			return err
+		}
+	}
+
+	return s.set(job)
+}
+
+func (s *kvStore) Get(id string) (*entities.Job, error) {
+	job, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	job.LogSize = s.LogSize(id)
+	return job, nil
+}
+
+func (s *kvStore) List() ([]*entities.Job, error) {
+	ids, err := s.getIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []*entities.Job{}
+	for _, id := range ids {
+		job, err := s.Get(id)
+		if err != nil {
+			continue
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+func (s *kvStore) Delete(id string) error {
+	job, err := s.get(id)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.logs, id)
+	s.mu.Unlock()
+
+	for attempt := 1; attempt < job.Attempt; attempt++ {
+		if record, err := s.getAttempt(id, attempt); err == nil {
+			s.deleteChunks(id, record.Log)
+		}
+		s.kv.Delete(s.getAttemptKey(id, attempt))
+	}
+
+	s.deleteLog(id)
+	if err := s.kv.Delete(kvJobPrefix + id); err != nil {
+		return err
+	}
+
+	return s.updateIndex(id, false)
+}
+
+// AppendLog buffers the output, which is flushed as a chunk when the buffer is full or by the timer.
+func (s *kvStore) AppendLog(id string, p []byte) error {
+	log, err := s.getLog(id)
+	if err != nil {
+		return err
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if log.meta.Compressed {
+		return fmt.Errorf("log of job(%s) is closed", id)
+	}
+
+	log.buf.Write(p)
+	if log.buf.Len() >= kvLogChunkSize {
+		return s.flush(id, log)
+	}
+
+	if log.timer == nil && log.buf.Len() > 0 {
+		log.timer = time.AfterFunc(kvLogFlushInterval, func() {
+			if err := s.flushLog(id, false); err != nil {
+				logger.Errorf("[store] failed to flush log of job(%s): %s", id, err)
+			}
+		})
+	}
+
+	return nil
+}
+
+// ReadLog reads the flushed chunks and the buffered log, the lock is only held to take the snapshot.
+func (s *kvStore) ReadLog(id string, offset int64) (io.ReadCloser, error) {
+	meta, buffered := s.snapshotLog(id)
+	return s.readLog(id, meta, buffered, offset)
+}
+
+func (s *kvStore) GetAttempt(id string, attempt int) (*entities.Job, error) {
+	record, err := s.getAttempt(id, attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	record.Job.LogSize = record.Log.Size
+	return record.Job, nil
+}
+
+func (s *kvStore) ReadAttemptLog(id string, attempt int, offset int64) (io.ReadCloser, error) {
+	record, err := s.getAttempt(id, attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.readLog(id, record.Log, nil, offset)
+}
+
+// readLog reads the chunks of meta and the buffered log from offset.
+func (s *kvStore) readLog(id string, meta *kvLogMeta, buffered []byte, offset int64) (io.ReadCloser, error) {
+	content, err := s.readChunks(id, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.Compressed {
+		reader, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read compressed log: %s", err)
+		}
+		defer reader.Close()
+
+		if content, err = io.ReadAll(reader); err != nil {
+			return nil, fmt.Errorf("failed to read compressed log: %s", err)
+		}
+	}
+
+	buf := bytes.NewBuffer(append(content, buffered...))
+	if offset > int64(buf.Len()) {
+		offset = int64(buf.Len())
+	}
+	if offset > 0 {
+		buf.Next(int(offset))
+	}
+
+	return io.NopCloser(buf), nil
+}
+
+func (s *kvStore) LogSize(id string) int64 {
+	meta, buffered := s.snapshotLog(id)
+	return meta.Size + int64(len(buffered))
+}
+
+// CloseLog flushes the buffered log, and compresses the chunks into one chunk if compress.
+func (s *kvStore) CloseLog(id string, compress bool) error {
+	if err := s.flushLog(id, true); err != nil {
+		return err
+	}
+
+	meta := s.getLogMeta(id)
+	if !compress || meta.Compressed || meta.Chunks == 0 {
+		return nil
+	}
+
+	content, err := s.readChunks(id, meta)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	if _, err := writer.Write(content); err != nil {
+		return fmt.Errorf("failed to compress log: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to compress log: %s", err)
+	}
+
+	// the compressed chunk is written after the others, and replaces them by meta,
+	// so that the readers with the previous meta still read the complete chunks
+	next := meta.First + meta.Chunks
+	if err := s.setValue(s.getLogKey(id, next), base64.StdEncoding.EncodeToString(buf.Bytes())); err != nil {
+		return fmt.Errorf("failed to compress log: %s", err)
+	}
+	if err := s.setLogMeta(id, &kvLogMeta{First: next, Chunks: 1, Size: int64(buf.Len()), Compressed: true}); err != nil {
+		return err
+	}
+	for i := meta.First; i < next; i++ {
+		s.kv.Delete(s.getLogKey(id, i))
+	}
+
+	return nil
+}
+
+// archive keeps the record and log meta of the last attempt, the log of next attempt starts after its chunks.
+func (s *kvStore) archive(last *entities.Job) error {
+	meta := s.getLogMeta(last.ID)
+	value, err := json.Marshal(&kvAttemptRecord{Job: last, Log: meta})
+	if err != nil {
+		return fmt.Errorf("failed to encode job(%s): %s", last.ID, err)
+	}
+
+	if err := s.setValue(s.getAttemptKey(last.ID, getArchivedAttempt(last)), string(value)); err != nil {
+		return fmt.Errorf("failed to archive job(%s): %s", last.ID, err)
+	}
+
+	return s.setLogMeta(last.ID, &kvLogMeta{First: meta.First + meta.Chunks})
+}
+
+func (s *kvStore) getAttempt(id string, attempt int) (*kvAttemptRecord, error) {
+	key := s.getAttemptKey(id, attempt)
+	if !s.kv.Has(key) {
+		return nil, ErrJobNotFound
+	}
+
+	var value string
+	if err := s.kv.Get(key, &value); err != nil {
+		return nil, fmt.Errorf("failed to get job(%s) attempt(%d): %s", id, attempt, err)
+	}
+
+	record := &kvAttemptRecord{}
+	if err := json.Unmarshal([]byte(value), record); err != nil {
+		return nil, fmt.Errorf("failed to decode job(%s) attempt(%d): %s", id, attempt, err)
+	}
+	if record.Job == nil || record.Log == nil {
+		return nil, ErrJobNotFound
+	}
+
+	return record, nil
+}
+
+// getLog returns the log being appended, the meta is loaded from kv at first.
+func (s *kvStore) getLog(id string) (*kvLog, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if log, ok := s.logs[id]; ok {
+		return log, nil
+	}
+
+	if !s.kv.Has(kvJobPrefix + id) {
+		return nil, ErrJobNotFound
+	}
+
+	log := &kvLog{
+		meta: s.getLogMeta(id),
+	}
+	s.logs[id] = log
+	return log, nil
+}
+
+// snapshotLog returns the meta and the buffered log.
+func (s *kvStore) snapshotLog(id string) (*kvLogMeta, []byte) {
+	s.mu.Lock()
+	log, ok := s.logs[id]
+	s.mu.Unlock()
+	if !ok {
+		return s.getLogMeta(id), nil
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	meta := *log.meta
+	return &meta, append([]byte{}, log.buf.Bytes()...)
+}
+
+// flushLog flushes the buffered log of job, and forgets it if done.
+func (s *kvStore) flushLog(id string, done bool) error {
+	s.mu.Lock()
+	log, ok := s.logs[id]
+	if ok && done {
+		delete(s.logs, id)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	return s.flush(id, log)
+}
+
+// flush writes the buffer as a new chunk, the meta is written after the chunk, so that the chunk is complete.
+func (s *kvStore) flush(id string, log *kvLog) error {
+	if log.timer != nil {
+		log.timer.Stop()
+		log.timer = nil
+	}
+	if log.buf.Len() == 0 {
+		return nil
+	}
+
+	if err := s.setValue(s.getLogKey(id, log.meta.First+log.meta.Chunks), base64.StdEncoding.EncodeToString(log.buf.Bytes())); err != nil {
+		return fmt.Errorf("failed to append log: %s", err)
+	}
+
+	meta := &kvLogMeta{
+		First:  log.meta.First,
+		Chunks: log.meta.Chunks + 1,
+		Size:   log.meta.Size + int64(log.buf.Len()),
+	}
+	if err := s.setLogMeta(id, meta); err != nil {
+		return err
+	}
+
+	log.meta = meta
+	log.buf.Reset()
+	return nil
+}
+
+func (s *kvStore) readChunks(id string, meta *kvLogMeta) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for i := meta.First; i < meta.First+meta.Chunks; i++ {
+		var chunk string
+		if err := s.kv.Get(s.getLogKey(id, i), &chunk); err != nil {
+			return nil, fmt.Errorf("failed to read log: %s", err)
+		}
+
+		p, err := base64.StdEncoding.DecodeString(chunk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode log: %s", err)
+		}
+
+		buf.Write(p)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (s *kvStore) get(id string) (*entities.Job, error) {
+	key := kvJobPrefix + id
+	if !s.kv.Has(key) {
+		return nil, ErrJobNotFound
+	}
+
+	var value string
+	if err := s.kv.Get(key, &value); err != nil {
+		return nil, fmt.Errorf("failed to get job(%s): %s", id, err)
+	}
+
+	record := &kvRecord{}
+	if err := json.Unmarshal([]byte(value), record); err != nil {
+		return nil, fmt.Errorf("failed to decode job(%s): %s", id, err)
+	}
+	if record.Job == nil {
+		return nil, ErrJobNotFound
+	}
+
+	return record.Job, nil
+}
+
+func (s *kvStore) set(job *entities.Job) error {
+	value, err := json.Marshal(&kvRecord{Job: job})
+	if err != nil {
+		return fmt.Errorf("failed to encode job(%s): %s", job.ID, err)
+	}
+
+	if err := s.setValue(kvJobPrefix+job.ID, string(value)); err != nil {
+		return fmt.Errorf("failed to save job(%s): %s", job.ID, err)
+	}
+
+	return nil
+}
+
+// getLogMeta returns the meta of log, empty if not found.
+func (s *kvStore) getLogMeta(id string) *kvLogMeta {
+	meta := &kvLogMeta{}
+
+	var value string
+	if err := s.kv.Get(kvLogMetaPrefix+id, &value); err != nil || value == "" {
+		return meta
+	}
+
+	json.Unmarshal([]byte(value), meta)
+	return meta
+}
+
+func (s *kvStore) setLogMeta(id string, meta *kvLogMeta) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	if err := s.setValue(kvLogMetaPrefix+id, string(value)); err != nil {
+		return fmt.Errorf("failed to save log meta of job(%s): %s", id, err)
+	}
+
+	return nil
+}
+
+// getIndex returns the job ids in index, which is built from the keys of job records if not found.
+func (s *kvStore) getIndex() ([]string, error) {
+	if !s.kv.Has(kvJobIndexKey) {
+		ids := []string{}
+		for _, key := range s.kv.Keys() {
+			if strings.HasPrefix(key, kvJobPrefix) {
+				ids = append(ids, strings.TrimPrefix(key, kvJobPrefix))
+			}
+		}
+
+		return ids, nil
+	}
+
+	var value string
+	if err := s.kv.Get(kvJobIndexKey, &value); err != nil {
+		return nil, fmt.Errorf("failed to get job index: %s", err)
+	}
+
+	ids := []string{}
+	if err := json.Unmarshal([]byte(value), &ids); err != nil {
+		return nil, fmt.Errorf("failed to decode job index: %s", err)
+	}
+
+	return ids, nil
+}
+
+// updateIndex adds or removes the job id in index.
+func (s *kvStore) updateIndex(id string, add bool) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	ids, err := s.getIndex()
+	if err != nil {
+		return err
+	}
+
+	next := []string{}
+	for _, one := range ids {
+		if one != id {
+			next = append(next, one)
+		}
+	}
+	if isIndexed := len(next) != len(ids); isIndexed == add && s.kv.Has(kvJobIndexKey) {
+		return nil
+	}
+	if add {
+		next = append(next, id)
+	}
+
+	value, err := json.Marshal(next)
+	if err != nil {
+		return fmt.Errorf("failed to encode job index: %s", err)
+	}
+
+	if err := s.setValue(kvJobIndexKey, string(value)); err != nil {
+		return fmt.Errorf("failed to save job index: %s", err)
+	}
+
+	return nil
+}
+
+// setValue sets the string value, which is stored by pointer as the memory engine requires.
+func (s *kvStore) setValue(key string, value string) error {
+	return s.kv.Set(key, &value)
+}
+
+func (s *kvStore) deleteLog(id string) {
+	s.deleteChunks(id, s.getLogMeta(id))
+	s.kv.Delete(kvLogMetaPrefix + id)
+}
+
+func (s *kvStore) deleteChunks(id string, meta *kvLogMeta) {
+	for i := meta.First; i < meta.First+meta.Chunks; i++ {
+		s.kv.Delete(s.getLogKey(id, i))
+	}
+}
+
+func (s *kvStore) getAttemptKey(id string, attempt int) string {
+	return fmt.Sprintf("%s%s:%d", kvAttemptPrefix, id, attempt)
+}
+
+func (s *kvStore) getLogKey(id string, index int) string {
+	return fmt.Sprintf("%s%s:%d", kvLogPrefix, id, index)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+func newTestKVStore(t *testing.T) *kvStore {
+	t.Helper()
+
+	store, err := newKVStore(&Config{JobStoreKVEngine: "memory"})
+	if err != nil {
+		t.Fatalf("failed to create kv store: %s", err)
+	}
+
+	return store
+}
+
+func TestKVStoreFlushLogByTimer(t *testing.T) {
+	store := newTestKVStore(t)
+	if err := store.Create(&entities.Job{ID: "job-1"}); err != nil {
+		t.Fatalf("failed to create job: %s", err)
+	}
+	if err := store.AppendLog("job-1", []byte("hello")); err != nil {
+		t.Fatalf("failed to append log: %s", err)
+	}
+
+	// other instance shares the kv, but not the buffered log
+	other := &kvStore{kv: store.kv, logs: map[string]*kvLog{}}
+	if size := other.LogSize("job-1"); size != 0 {
+		t.Fatalf("expected the log is buffered, got size %d", size)
+	}
+
+	deadline := time.Now().Add(3 * kvLogFlushInterval)
+	for other.LogSize("job-1") != 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the log is flushed by timer, got size %d", other.LogSize("job-1"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if log := readTestStoreLog(t, other, "job-1", 0); log != "hello" {
+		t.Fatalf("expected log %q, got %q", "hello", log)
+	}
+
+	// the full buffer is flushed at once
+	if err := store.AppendLog("job-1", make([]byte, kvLogChunkSize)); err != nil {
+		t.Fatalf("failed to append log: %s", err)
+	}
+	if size := other.LogSize("job-1"); size != 5+kvLogChunkSize {
+		t.Fatalf("expected the full buffer is flushed, got size %d", size)
+	}
+}
+
+func TestKVStoreIndex(t *testing.T) {
+	testcases := []struct {
+		name     string
+		create   []string
+		delete   []string
+		expected string
+	}{
+		{name: "empty"},
+		{name: "create", create: []string{"job-1", "job-2"}, expected: "job-1,job-2"},
+		{name: "create again", create: []string{"job-1", "job-1"}, expected: "job-1"},
+		{name: "delete", create: []string{"job-1", "job-2"}, delete: []string{"job-1"}, expected: "job-2"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newTestKVStore(t)
+			for _, id := range tc.create {
+				if err := store.Create(&entities.Job{ID: id}); err != nil {
+					t.Fatalf("failed to create job: %s", err)
+				}
+				store.AppendLog(id, []byte("output"))
+				store.CloseLog(id, false)
+			}
+			for _, id := range tc.delete {
+				if err := store.Delete(id); err != nil {
+					t.Fatalf("failed to delete job: %s", err)
+				}
+			}
+
+			ids, err := store.getIndex()
+			if err != nil {
+				t.Fatalf("failed to get index: %s", err)
+			}
+			sort.Strings(ids)
+			if strings.Join(ids, ",") != tc.expected {
+				t.Fatalf("expected index %q, got %v", tc.expected, ids)
+			}
+		})
+	}
+}
+
+func TestKVStoreIndexLegacy(t *testing.T) {
+	store := newTestKVStore(t)
+	for _, id := range []string{"job-1", "job-2"} {
+		if err := store.set(&entities.Job{ID: id}); err != nil {
+			t.Fatalf("failed to save job: %s", err)
+		}
+	}
+	store.setValue(store.getLogKey("job-1", 0), "")
+
+	// the store without index lists the jobs by keys
+	jobs, err := store.List()
+	if err != nil {
+		t.Fatalf("failed to list jobs: %s", err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("expected 2 jobs, got %d", len(jobs))
+	}
+
+	// the index is built by the first update
+	if err := store.Delete("job-1"); err != nil {
+		t.Fatalf("failed to delete job: %s", err)
+	}
+	if !store.kv.Has(kvJobIndexKey) {
+		t.Fatal("expected the index is saved")
+	}
+	if ids, _ := store.getIndex(); strings.Join(ids, ",") != "job-2" {
+		t.Fatalf("expected index job-2, got %v", ids)
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// newTestJobStores returns the job stores of each implementation.
+func newTestJobStores(t *testing.T) map[string]JobStore {
+	t.Helper()
+
+	kvStore, err := newKVStore(&Config{JobStoreKVDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("failed to create kv store: %s", err)
+	}
+
+	kvMemoryStore, err := newKVStore(&Config{JobStoreKVEngine: "memory"})
+	if err != nil {
+		t.Fatalf("failed to create kv store: %s", err)
+	}
+
+	return map[string]JobStore{
+		JobStoreFileSystem:     newFileSystemStore(t.TempDir()),
+		JobStoreKV:             kvStore,
+		JobStoreKV + "-memory": kvMemoryStore,
+	}
+}
+
+func readTestStoreLog(t *testing.T, store JobStore, id string, offset int64) string {
+	t.Helper()
+
+	reader, err := store.ReadLog(id, offset)
+	if err != nil {
+		t.Fatalf("failed to read log: %s", err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read log: %s", err)
+	}
+
+	return string(content)
+}
+
+func TestNewJobStore(t *testing.T) {
+	testcases := []struct {
+		name string
+		cfg  *Config
+		err  string
+	}{
+		{name: "filesystem", cfg: &Config{MetadataDir: t.TempDir()}},
+		{name: "kv", cfg: &Config{JobStore: JobStoreKV, JobStoreKVDir: t.TempDir()}},
+		{name: "shared without instance", cfg: &Config{JobStore: JobStoreKV, JobStoreKVEngine: "redis"}, err: "instance_id is required"},
+		{name: "unknown", cfg: &Config{JobStore: "unknown"}, err: "unknown job store"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewJobStore(tc.cfg)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestJobStoreRecord(t *testing.T) {
+	for name, store := range newTestJobStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.Get("job-1"); err != ErrJobNotFound {
+				t.Fatalf("expected %s, got %v", ErrJobNotFound, err)
+			}
+
+			createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			job := &entities.Job{
+				ID:         "job-1",
+				ClientID:   "client-1",
+				Script:     "echo hello",
+				ScriptHash: entities.HashScript("echo hello"),
+				EnvKeys:    []string{"A", "B"},
+				Status:     entities.JobStatusRunning,
+				CreatedAt:  createdAt,
+				StartedAt:  &createdAt,
+			}
+			if err := store.Create(job); err != nil {
+				t.Fatalf("failed to create job: %s", err)
+			}
+
+			finishedAt := createdAt.Add(time.Second)
+			job.Status = entities.JobStatusFailure
+			job.FinishedAt = &finishedAt
+			job.Exit = &entities.Exit{Code: 1, Reason: entities.ExitReasonExited, Duration: 1000}
+			job.StdoutBytes = 10
+			if err := store.Update(job); err != nil {
+				t.Fatalf("failed to update job: %s", err)
+			}
+
+			got, err := store.Get("job-1")
+			if err != nil {
+				t.Fatalf("failed to get job: %s", err)
+			}
+			if !reflect.DeepEqual(got, job) {
+				t.Fatalf("expected job %+v, got %+v", job, got)
+			}
+
+			if err := store.Create(&entities.Job{ID: "job-2", Script: "ls"}); err != nil {
+				t.Fatalf("failed to create job: %s", err)
+			}
+
+			jobs, err := store.List()
+			if err != nil {
+				t.Fatalf("failed to list jobs: %s", err)
+			}
+			ids := []string{}
+			for _, job := range jobs {
+				ids = append(ids, job.ID)
+			}
+			sort.Strings(ids)
+			if strings.Join(ids, ",") != "job-1,job-2" {
+				t.Fatalf("expected jobs job-1,job-2, got %v", ids)
+			}
+
+			if err := store.Delete("job-1"); err != nil {
+				t.Fatalf("failed to delete job: %s", err)
+			}
+			if _, err := store.Get("job-1"); err != ErrJobNotFound {
+				t.Fatalf("expected %s after delete, got %v", ErrJobNotFound, err)
+			}
+		})
+	}
+}
+
+func TestJobStoreLog(t *testing.T) {
+	for name, store := range newTestJobStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.Create(&entities.Job{ID: "job-1"}); err != nil {
+				t.Fatalf("failed to create job: %s", err)
+			}
+
+			for _, p := range []string{"hello ", "world", "\n"} {
+				if err := store.AppendLog("job-1", []byte(p)); err != nil {
+					t.Fatalf("failed to append log: %s", err)
+				}
+			}
+
+			if size := store.LogSize("job-1"); size != 12 {
+				t.Fatalf("expected log size 12, got %d", size)
+			}
+
+			testcases := map[int64]string{
+				0:   "hello world\n",
+				6:   "world\n",
+				100: "",
+			}
+			for offset, expected := range testcases {
+				if log := readTestStoreLog(t, store, "job-1", offset); log != expected {
+					t.Fatalf("expected log %q from offset %d, got %q", expected, offset, log)
+				}
+			}
+
+			// the log is reset by creating the job with the same id
+			if err := store.Create(&entities.Job{ID: "job-1"}); err != nil {
+				t.Fatalf("failed to create job: %s", err)
+			}
+			if log := readTestStoreLog(t, store, "job-1", 0); log != "" {
+				t.Fatalf("expected log reset, got %q", log)
+			}
+
+			store.AppendLog("job-1", []byte("again"))
+			if err := store.Delete("job-1"); err != nil {
+				t.Fatalf("failed to delete job: %s", err)
+			}
+			if size := store.LogSize("job-1"); size != 0 {
+				t.Fatalf("expected log deleted, got size %d", size)
+			}
+		})
+	}
+}
+
+func TestJobStoreAttempts(t *testing.T) {
+	for name, store := range newTestJobStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.Create(&entities.Job{ID: "job-1", Status: entities.JobStatusFailure}); err != nil {
+				t.Fatalf("failed to create job: %s", err)
+			}
+			store.AppendLog("job-1", []byte("first"))
+
+			// the first attempt is archived by running again
+			if err := store.Create(&entities.Job{ID: "job-1", Status: entities.JobStatusRunning, Attempt: 2}); err != nil {
+				t.Fatalf("failed to create job: %s", err)
+			}
+			store.AppendLog("job-1", []byte("second"))
+
+			job, err := store.Get("job-1")
+			if err != nil {
+				t.Fatalf("failed to get job: %s", err)
+			}
+			if job.Attempt != 2 || job.Status != entities.JobStatusRunning {
+				t.Fatalf("expected the current attempt 2 running, got %d %s", job.Attempt, job.Status)
+			}
+			if log := readTestStoreLog(t, store, "job-1", 0); log != "second" {
+				t.Fatalf("expected log %q, got %q", "second", log)
+			}
+
+			attempt, err := store.GetAttempt("job-1", 1)
+			if err != nil {
+				t.Fatalf("failed to get attempt: %s", err)
+			}
+			if attempt.Status != entities.JobStatusFailure || attempt.LogSize != 5 {
+				t.Fatalf("expected the archived attempt failure with log size 5, got %s %d", attempt.Status, attempt.LogSize)
+			}
+
+			reader, err := store.ReadAttemptLog("job-1", 1, 1)
+			if err != nil {
+				t.Fatalf("failed to read attempt log: %s", err)
+			}
+			content, _ := io.ReadAll(reader)
+			reader.Close()
+			if string(content) != "irst" {
+				t.Fatalf("expected attempt log %q, got %q", "irst", content)
+			}
+
+			if _, err := store.GetAttempt("job-1", 2); err != ErrJobNotFound {
+				t.Fatalf("expected current attempt not archived, got %v", err)
+			}
+
+			if err := store.Delete("job-1"); err != nil {
+				t.Fatalf("failed to delete job: %s", err)
+			}
+			if _, err := store.GetAttempt("job-1", 1); err != ErrJobNotFound {
+				t.Fatalf("expected attempt deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestJobStoreCloseLog(t *testing.T) {
+	for name, store := range newTestJobStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.Create(&entities.Job{ID: "job-1"}); err != nil {
+				t.Fatalf("failed to create job: %s", err)
+			}
+			store.AppendLog("job-1", []byte("hello "))
+			store.AppendLog("job-1", []byte("world\n"))
+
+			if err := store.CloseLog("job-1", true); err != nil {
+				t.Fatalf("failed to close log: %s", err)
+			}
+			// closing again is nothing
+			if err := store.CloseLog("job-1", true); err != nil {
+				t.Fatalf("failed to close log again: %s", err)
+			}
+
+			// the compressed log is read as the raw log
+			if log := readTestStoreLog(t, store, "job-1", 0); log != "hello world\n" {
+				t.Fatalf("expected log, got %q", log)
+			}
+			if log := readTestStoreLog(t, store, "job-1", 6); log != "world\n" {
+				t.Fatalf("expected log from offset, got %q", log)
+			}
+		})
+	}
+}
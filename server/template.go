@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+// CommandTemplate is the named command, whose script is rendered by text/template with the typed params.
+// All the rendered values are shell quoted, so that `echo {{.name}}` is safe.
+type CommandTemplate struct {
+	Description string                    `json:"description"`
+	Script      string                    `json:"script"`
+	Params      map[string]*TemplateParam `json:"params"`
+	//
+	tmpl *template.Template
+}
+
+// TemplateParam is the typed param of template, type is string (default), int, number or bool.
+type TemplateParam struct {
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+	Default  any    `json:"default"`
+	// Enum is the allowed values of string
+	Enum []string `json:"enum"`
+	// Pattern is the regexp of string
+	Pattern string `json:"pattern"`
+	// Min and Max is the range of int and number
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+	//
+	pattern *regexp.Regexp
+}
+
+// CommandRegistry is the named command templates and the allow and deny rules of raw scripts
+type CommandRegistry struct {
+	templates map[string]*CommandTemplate
+	allow     []*regexp.Regexp
+	deny      []*regexp.Regexp
+	// isTemplateOnly denies all raw scripts
+	isTemplateOnly bool
+}
+
+// NewCommandRegistry creates the registry by the template file and script patterns of config.
+func NewCommandRegistry(cfg *Config) (*CommandRegistry, error) {
+	registry := &CommandRegistry{
+		templates:      map[string]*CommandTemplate{},
+		isTemplateOnly: cfg.IsTemplateOnly,
+	}
+
+	for _, pattern := range cfg.ScriptAllowPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid script allow pattern(%s): %s", pattern, err)
+		}
+		registry.allow = append(registry.allow, re)
+	}
+
+	for _, pattern := range cfg.ScriptDenyPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid script deny pattern(%s): %s", pattern, err)
+		}
+		registry.deny = append(registry.deny, re)
+	}
+
+	if cfg.TemplateFile == "" {
+		return registry, nil
+	}
+
+	content, err := os.ReadFile(cfg.TemplateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template file: %s", err)
+	}
+
+	file := &struct {
+		Templates map[string]*CommandTemplate `json:"templates"`
+	}{}
+	if err := json.Unmarshal(content, file); err != nil {
+		return nil, fmt.Errorf("failed to decode template file: %s", err)
+	}
+
+	for name, tpl := range file.Templates {
+		if tpl == nil || tpl.Script == "" {
+			return nil, fmt.Errorf("template(%s) has no script", name)
+		}
+
+		if tpl.tmpl, err = template.New(name).Option("missingkey=error").Parse(tpl.Script); err != nil {
+			return nil, fmt.Errorf("invalid template(%s): %s", name, err)
+		}
+
+		for key, param := range tpl.Params {
+			if param == nil {
+				return nil, fmt.Errorf("template(%s) param(%s) has no type", name, key)
+			}
+
+			switch param.Type {
+			case "":
+				param.Type = "string"
+			case "string", "int", "number", "bool":
+			default:
+				return nil, fmt.Errorf("template(%s) param(%s) has unknown type: %s", name, key, param.Type)
+			}
+
+			if param.Pattern != "" {
+				if param.pattern, err = regexp.Compile(param.Pattern); err != nil {
+					return nil, fmt.Errorf("template(%s) param(%s) has invalid pattern: %s", name, key, err)
+				}
+			}
+
+			// the default is validated as the args, so that it is not rejected until rendering
+			if _, err := param.render(param.Default); err != nil {
+				return nil, fmt.Errorf("template(%s) param(%s) has invalid default: %s", name, key, err)
+			}
+		}
+
+		registry.templates[name] = tpl
+	}
+
+	return registry, nil
+}
+
+// Render renders the script of command by its template and args.
+func (r *CommandRegistry) Render(command *entities.Command) error {
+	if command.Script != "" {
+		return fmt.Errorf("script and template cannot be used together")
+	}
+
+	tpl, ok := r.templates[command.Template]
+	if !ok {
+		return fmt.Errorf("template(%s) not found", command.Template)
+	}
+
+	for key := range command.Args {
+		if _, ok := tpl.Params[key]; !ok {
+			return fmt.Errorf("template(%s) has no param: %s", command.Template, key)
+		}
+	}
+
+	data := map[string]string{}
+	for key, param := range tpl.Params {
+		value, ok := command.Args[key]
+		if !ok || value == nil {
+			if param.Required {
+				return fmt.Errorf("param(%s) is required", key)
+			}
+
+			value = param.Default
+		}
+
+		rendered, err := param.render(value)
+		if err != nil {
+			return fmt.Errorf("invalid param(%s): %s", key, err)
+		}
+
+		data[key] = rendered
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tpl.tmpl.Execute(buf, data); err != nil {
+		return fmt.Errorf("failed to render template(%s): %s", command.Template, err)
+	}
+
+	command.Script = buf.String()
+	return nil
+}
+
+// Check checks the raw script by the deny and allow patterns.
+func (r *CommandRegistry) Check(script string) error {
+	if r.isTemplateOnly {
+		return fmt.Errorf("permission denied: raw script is not allowed, use template instead")
+	}
+
+	for _, re := range r.deny {
+		if re.MatchString(script) {
+			return fmt.Errorf("permission denied: script is denied by pattern: %s", re.String())
+		}
+	}
+
+	if len(r.allow) == 0 {
+		return nil
+	}
+
+	for _, re := range r.allow {
+		if re.MatchString(script) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("permission denied: script is not allowed by any pattern")
+}
+
+// render validates the value and returns it shell quoted, the nil value is an empty string.
+func (p *TemplateParam) render(value any) (string, error) {
+	if value == nil {
+		return shellQuote(""), nil
+	}
+
+	switch p.Type {
+	case "int", "number":
+		var n float64
+		switch v := value.(type) {
+		case float64:
+			n = v
+		case int:
+			n = float64(v)
+		case string:
+			var err error
+			if n, err = strconv.ParseFloat(v, 64); err != nil {
+				return "", fmt.Errorf("expect %s, got %s", p.Type, v)
+			}
+		default:
+			return "", fmt.Errorf("expect %s, got %v", p.Type, value)
+		}
+
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return "", fmt.Errorf("expect %s, got %v", p.Type, n)
+		}
+		if p.Type == "int" && (n < math.MinInt64 || n >= math.MaxInt64 || n != math.Trunc(n)) {
+			return "", fmt.Errorf("expect int, got %v", n)
+		}
+		if p.Min != nil && n < *p.Min {
+			return "", fmt.Errorf("%v is less than %v", n, *p.Min)
+		}
+		if p.Max != nil && n > *p.Max {
+			return "", fmt.Errorf("%v is greater than %v", n, *p.Max)
+		}
+
+		if p.Type == "int" {
+			return shellQuote(strconv.FormatInt(int64(n), 10)), nil
+		}
+		return shellQuote(strconv.FormatFloat(n, 'f', -1, 64)), nil
+	case "bool":
+		v, ok := value.(bool)
+		if !ok {
+			return "", fmt.Errorf("expect bool, got %v", value)
+		}
+
+		return shellQuote(strconv.FormatBool(v)), nil
+	default:
+		v, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("expect string, got %v", value)
+		}
+
+		if len(p.Enum) != 0 {
+			isMatched := false
+			for _, e := range p.Enum {
+				if v == e {
+					isMatched = true
+					break
+				}
+			}
+
+			if !isMatched {
+				return "", fmt.Errorf("%s is not one of %s", v, strings.Join(p.Enum, ", "))
+			}
+		}
+
+		if p.pattern != nil && !p.pattern.MatchString(v) {
+			return "", fmt.Errorf("%s does not match %s", v, p.Pattern)
+		}
+
+		return shellQuote(v), nil
+	}
+}
+
+// shellQuote quotes the value in single quotes for shell.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}
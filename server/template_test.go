@@ -0,0 +1,319 @@
+package server
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+)
+
+const testTemplateFile = `{
+	"templates": {
+		"greet": {
+			"script": "echo hello {{.name}}",
+			"params": {
+				"name": { "type": "string", "required": true }
+			}
+		},
+		"deploy": {
+			"script": "deploy --env {{.env}} --replicas {{.replicas}} --ratio {{.ratio}} --dry-run={{.dry_run}} --tag {{.tag}}",
+			"params": {
+				"env": { "enum": ["staging", "production"], "default": "staging" },
+				"replicas": { "type": "int", "min": 1, "max": 10, "default": 1 },
+				"ratio": { "type": "number", "min": 0, "max": 1, "default": 0.5 },
+				"dry_run": { "type": "bool", "default": false },
+				"tag": { "pattern": "^v[0-9]+\\.[0-9]+$", "default": "v1.0" }
+			}
+		},
+		"list": {
+			"script": "ls {{.dir}}",
+			"params": {
+				"dir": {}
+			}
+		}
+	}
+}`
+
+func newTestCommandRegistry(t *testing.T, cfg *Config) *CommandRegistry {
+	t.Helper()
+
+	if cfg.TemplateFile == "" {
+		cfg.TemplateFile = filepath.Join(t.TempDir(), "templates.json")
+		if err := os.WriteFile(cfg.TemplateFile, []byte(testTemplateFile), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	registry, err := NewCommandRegistry(cfg)
+	if err != nil {
+		t.Fatalf("failed to create registry: %s", err)
+	}
+
+	return registry
+}
+
+func TestCommandRegistryRender(t *testing.T) {
+	registry := newTestCommandRegistry(t, &Config{})
+
+	testcases := []struct {
+		name     string
+		template string
+		script   string
+		args     map[string]any
+		expected string
+		err      string
+	}{
+		{
+			name:     "string is quoted",
+			template: "greet",
+			args:     map[string]any{"name": "world"},
+			expected: "echo hello 'world'",
+		},
+		{
+			name:     "quote injection",
+			template: "greet",
+			args:     map[string]any{"name": "'; rm -rf / #"},
+			expected: `echo hello ''"'"'; rm -rf / #'`,
+		},
+		{
+			name:     "required",
+			template: "greet",
+			args:     map[string]any{},
+			err:      "param(name) is required",
+		},
+		{
+			name:     "unknown param",
+			template: "greet",
+			args:     map[string]any{"name": "world", "other": "x"},
+			err:      "has no param: other",
+		},
+		{
+			name:     "unknown template",
+			template: "unknown",
+			err:      "template(unknown) not found",
+		},
+		{
+			name:     "script with template",
+			template: "greet",
+			script:   "echo",
+			args:     map[string]any{"name": "world"},
+			err:      "script and template cannot be used together",
+		},
+		{
+			name:     "defaults",
+			template: "deploy",
+			expected: "deploy --env 'staging' --replicas '1' --ratio '0.5' --dry-run='false' --tag 'v1.0'",
+		},
+		{
+			name:     "args",
+			template: "deploy",
+			args:     map[string]any{"env": "production", "replicas": float64(3), "ratio": "0.25", "dry_run": true, "tag": "v2.1"},
+			expected: "deploy --env 'production' --replicas '3' --ratio '0.25' --dry-run='true' --tag 'v2.1'",
+		},
+		{
+			name:     "enum",
+			template: "deploy",
+			args:     map[string]any{"env": "dev"},
+			err:      "dev is not one of staging, production",
+		},
+		{
+			name:     "pattern",
+			template: "deploy",
+			args:     map[string]any{"tag": "v1.0; reboot"},
+			err:      "does not match",
+		},
+		{
+			name:     "min",
+			template: "deploy",
+			args:     map[string]any{"replicas": float64(0)},
+			err:      "0 is less than 1",
+		},
+		{
+			name:     "max",
+			template: "deploy",
+			args:     map[string]any{"replicas": float64(11)},
+			err:      "11 is greater than 10",
+		},
+		{
+			name:     "int is not float",
+			template: "deploy",
+			args:     map[string]any{"replicas": 1.5},
+			err:      "expect int",
+		},
+		{
+			name:     "int from invalid string",
+			template: "deploy",
+			args:     map[string]any{"replicas": "1; reboot"},
+			err:      "expect int",
+		},
+		{
+			name:     "number is not nan",
+			template: "deploy",
+			args:     map[string]any{"ratio": "NaN"},
+			err:      "expect number, got NaN",
+		},
+		{
+			name:     "number is not inf",
+			template: "deploy",
+			args:     map[string]any{"ratio": "-Inf"},
+			err:      "expect number, got -Inf",
+		},
+		{
+			name:     "int out of range",
+			template: "deploy",
+			args:     map[string]any{"replicas": "1e300"},
+			err:      "expect int",
+		},
+		{
+			name:     "nil is empty string",
+			template: "list",
+			expected: "ls ''",
+		},
+		{
+			name:     "bool type",
+			template: "deploy",
+			args:     map[string]any{"dry_run": "true"},
+			err:      "expect bool",
+		},
+		{
+			name:     "string type",
+			template: "greet",
+			args:     map[string]any{"name": float64(1)},
+			err:      "expect string",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			command := &entities.Command{Template: tc.template, Script: tc.script, Args: tc.args}
+			err := registry.Render(command)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if command.Script != tc.expected {
+				t.Fatalf("expected script %q, got %q", tc.expected, command.Script)
+			}
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not found")
+	}
+
+	for _, value := range []string{"", "plain", "with space", "it's", `"double"`, "$(id)", "`id`", "a\nb", `back\slash`, "'; rm -rf / #"} {
+		output, err := exec.Command("sh", "-c", "printf '%s' "+shellQuote(value)).Output()
+		if err != nil {
+			t.Fatalf("failed to run quoted %q: %s", value, err)
+		}
+
+		if string(output) != value {
+			t.Fatalf("expected %q, got %q", value, output)
+		}
+	}
+}
+
+func TestCommandRegistryCheck(t *testing.T) {
+	testcases := []struct {
+		name   string
+		cfg    *Config
+		script string
+		err    string
+	}{
+		{
+			name:   "no patterns",
+			cfg:    &Config{},
+			script: "rm -rf /tmp/x",
+		},
+		{
+			name:   "denied",
+			cfg:    &Config{ScriptDenyPatterns: []string{`rm\s+-rf`}},
+			script: "rm -rf /tmp/x",
+			err:    "denied by pattern",
+		},
+		{
+			name:   "allowed",
+			cfg:    &Config{ScriptAllowPatterns: []string{`^echo `}},
+			script: "echo hello",
+		},
+		{
+			name:   "not allowed",
+			cfg:    &Config{ScriptAllowPatterns: []string{`^echo `}},
+			script: "ls",
+			err:    "not allowed by any pattern",
+		},
+		{
+			name:   "deny before allow",
+			cfg:    &Config{ScriptAllowPatterns: []string{`^echo `}, ScriptDenyPatterns: []string{`;`}},
+			script: "echo hello; reboot",
+			err:    "denied by pattern",
+		},
+		{
+			name:   "template only",
+			cfg:    &Config{IsTemplateOnly: true},
+			script: "echo hello",
+			err:    "raw script is not allowed",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			registry, err := NewCommandRegistry(tc.cfg)
+			if err != nil {
+				t.Fatalf("failed to create registry: %s", err)
+			}
+
+			err = registry.Check(tc.script)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestNewCommandRegistryInvalid(t *testing.T) {
+	testcases := map[string]string{
+		"no script":       `{"templates": {"a": {"params": {}}}}`,
+		"unknown type":    `{"templates": {"a": {"script": "echo", "params": {"x": {"type": "date"}}}}}`,
+		"invalid pattern": `{"templates": {"a": {"script": "echo", "params": {"x": {"pattern": "("}}}}}`,
+		"invalid script":  `{"templates": {"a": {"script": "echo {{"}}}`,
+		"invalid default": `{"templates": {"a": {"script": "echo", "params": {"x": {"type": "int", "default": "x"}}}}}`,
+		"default of enum": `{"templates": {"a": {"script": "echo", "params": {"x": {"enum": ["a"], "default": "b"}}}}}`,
+		"default range":   `{"templates": {"a": {"script": "echo", "params": {"x": {"type": "number", "max": 1, "default": 2}}}}}`,
+	}
+
+	for name, content := range testcases {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "templates.json")
+			if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := NewCommandRegistry(&Config{TemplateFile: file}); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+
+	if _, err := NewCommandRegistry(&Config{ScriptDenyPatterns: []string{"("}}); err == nil {
+		t.Fatal("expected error of invalid deny pattern")
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/go-zoox/command"
+	"github.com/go-zoox/command/errors"
+	"github.com/go-zoox/command/terminal"
+	"github.com/go-zoox/logger"
+)
+
+// runInTerminal runs the command in a pty, the output of stdout and stderr are merged by the pty.
+func runInTerminal(job *Job, cmd command.Command, stdin io.Reader, stdout io.Writer) error {
+	term, err := cmd.Terminal()
+	if err != nil {
+		return err
+	}
+	defer term.Close()
+
+	job.Start()
+	job.SetTerminal(term)
+
+	go func() {
+		if _, err := io.Copy(term, stdin); err != nil {
+			logger.Debugf("[terminal] failed to copy stdin: %s", err)
+		}
+	}()
+
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(stdout, term)
+		close(copied)
+	}()
+
+	err = term.Wait()
+
+	// drain the rest output before exit
+	select {
+	case <-copied:
+	case <-time.After(time.Second):
+	}
+
+	if err != nil {
+		// the wait status of host is kept for the signal, see getExitStatus
+		if _, ok := err.(*exec.ExitError); ok {
+			return err
+		}
+
+		return &errors.ExitError{
+			Code:    term.ExitCode(),
+			Message: err.Error(),
+		}
+	}
+
+	return nil
+}
+
+// SetTerminal sets the terminal of the command, and applies the pending size.
+func (j *Job) SetTerminal(term terminal.Terminal) {
+	j.terminalMu.Lock()
+	defer j.terminalMu.Unlock()
+
+	j.terminal = term
+	if j.terminalRows != 0 && j.terminalCols != 0 {
+		if err := term.Resize(j.terminalRows, j.terminalCols); err != nil {
+			logger.Errorf("[terminal] failed to resize: %s", err)
+		}
+	}
+}
+
+// ResizeTerminal resizes the terminal, the size is kept until the terminal is ready.
+func (j *Job) ResizeTerminal(rows, cols int) error {
+	if rows < 0 || cols < 0 {
+		return fmt.Errorf("invalid terminal size: %dx%d", rows, cols)
+	}
+
+	j.terminalMu.Lock()
+	defer j.terminalMu.Unlock()
+
+	j.terminalRows, j.terminalCols = rows, cols
+	if j.terminal == nil {
+		return nil
+	}
+
+	return j.terminal.Resize(rows, cols)
+}
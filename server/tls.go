@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// IsTLSEnabled returns whether the server listens with tls.
+func (c *Config) IsTLSEnabled() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// newTLSConfig creates the tls config of server, the client certificate is verified by TLSClientCA,
+// and required if IsTLSClientCertRequired.
+func newTLSConfig(cfg *Config) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.TLSClientCA != "" {
+		content, err := os.ReadFile(cfg.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client ca: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("failed to parse client ca: no certificate found")
+		}
+
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.IsTLSClientCertRequired {
+			tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if cfg.IsTLSClientCertRequired {
+		return nil, fmt.Errorf("client ca is required when client certificate is required")
+	}
+
+	return tlsCfg, nil
+}
+
+// getCertIdentity returns the identity of verified client certificate, or nil if not given.
+// The client id is the common name of subject, or the whole subject if no common name.
+func getCertIdentity(r *http.Request) *Identity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	identity := &Identity{
+		ClientID: cert.Subject.CommonName,
+		Subject:  cert.Subject.String(),
+		Scopes:   []string{},
+	}
+	if identity.ClientID == "" {
+		identity.ClientID = identity.Subject
+	}
+
+	return identity
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-zoox/commands-as-a-service/entities"
+	"github.com/go-zoox/logger"
+	"github.com/go-zoox/websocket"
+)
+
+// viewerQueueSize is the max pending output writes of one viewer, the viewer which falls behind is disconnected
+const viewerQueueSize = 256
+
+// viewerDrainTimeout is the max time to wait for a viewer to write its pending output and exit when the job is done
+const viewerDrainTimeout = 10 * time.Second
+
+// Viewer views the output and exit of a job
+type Viewer interface {
+	WriteOutput(flag byte, p []byte) error
+	WriteExit(exit *entities.Exit) error
+}
+
+// QueueViewer is the optional interface of viewer, which views the queue position of job
+type QueueViewer interface {
+	WriteQueued(queue *entities.Queue) error
+}
+
+// wsViewer views the job in a stream of websocket connection
+type wsViewer struct {
+	conn   websocket.Conn
+	stream string
+}
+
+func (v *wsViewer) WriteOutput(flag byte, p []byte) error {
+	return v.conn.WriteTextMessage(entities.EncodeFrame(flag, v.stream, p))
+}
+
+func (v *wsViewer) WriteExit(exit *entities.Exit) error {
+	return writeExit(v.conn, v.stream, exit)
+}
+
+func (v *wsViewer) WriteQueued(queue *entities.Queue) error {
+	payload, err := json.Marshal(queue)
+	if err != nil {
+		return err
+	}
+
+	return v.conn.WriteTextMessage(entities.EncodeFrame(entities.MessageCommandQueued, v.stream, payload))
+}
+
+// queuedViewer writes the output and exit to the viewer in its own goroutine,
+// so that a slow viewer, like the connection of slow network, does not block the job and other viewers.
+// The output is queued up to viewerQueueSize, see Job.write for the viewer which falls behind.
+type queuedViewer struct {
+	viewer Viewer
+	ch     chan queuedOutput
+	// exit is set before ch is closed, which is written after the pending output
+	exit   *entities.Exit
+	failed atomic.Bool
+	done   chan struct{}
+}
+
+type queuedOutput struct {
+	flag byte
+	data []byte
+}
+
+func newQueuedViewer(viewer Viewer) *queuedViewer {
+	v := &queuedViewer{
+		viewer: viewer,
+		ch:     make(chan queuedOutput, viewerQueueSize),
+		done:   make(chan struct{}),
+	}
+
+	go v.run()
+	return v
+}
+
+func (v *queuedViewer) run() {
+	defer close(v.done)
+
+	for output := range v.ch {
+		if v.failed.Load() {
+			continue
+		}
+
+		// the broken viewer, like closed connection, is removed by the next push
+		if err := v.viewer.WriteOutput(output.flag, output.data); err != nil {
+			logger.Debugf("[viewer] failed to write output: %s", err)
+			v.failed.Store(true)
+		}
+	}
+
+	if v.exit != nil && !v.failed.Load() {
+		if err := v.viewer.WriteExit(v.exit); err != nil {
+			logger.Debugf("[viewer] failed to write exit: %s", err)
+		}
+	}
+}
+
+// push queues the output, returns false if the viewer is broken or falls behind.
+func (v *queuedViewer) push(flag byte, p []byte) bool {
+	if v.failed.Load() {
+		return false
+	}
+
+	select {
+	case v.ch <- queuedOutput{flag: flag, data: append([]byte{}, p...)}:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the viewer after the pending output is written, the exit is written at last if not nil.
+// It must be called once.
+func (v *queuedViewer) close(exit *entities.Exit) {
+	v.exit = exit
+	close(v.ch)
+}
+
+// wait waits for the pending output and exit to be written, or the timeout.
+func (v *queuedViewer) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-v.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// pendingViewer holds the live output until the history log is replayed
+type pendingViewer struct {
+	Viewer
+	//
+	mu      sync.Mutex
+	ready   bool
+	pending []func() error
+}
+
+func newPendingViewer(viewer Viewer) *pendingViewer {
+	return &pendingViewer{
+		Viewer: viewer,
+	}
+}
+
+func (v *pendingViewer) WriteOutput(flag byte, p []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.ready {
+		return v.Viewer.WriteOutput(flag, p)
+	}
+
+	data := append([]byte{}, p...)
+	v.pending = append(v.pending, func() error {
+		return v.Viewer.WriteOutput(flag, data)
+	})
+	return nil
+}
+
+func (v *pendingViewer) WriteExit(exit *entities.Exit) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.ready {
+		return v.Viewer.WriteExit(exit)
+	}
+
+	v.pending = append(v.pending, func() error {
+		return v.Viewer.WriteExit(exit)
+	})
+	return nil
+}
+
+// Ready writes the pending output, and then writes directly.
+func (v *pendingViewer) Ready() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.ready = true
+	for _, write := range v.pending {
+		if err := write(); err != nil {
+			return err
+		}
+	}
+	v.pending = nil
+
+	return nil
+}
+
+// replayLog replays the output in range [offset, end) of the log to the viewer, end -1 means all.
+// The truncation markers are not replayed, so that the offset of output is kept.
+func replayLog(store JobStore, record *entities.Job, offset, end int64, viewer Viewer) error {
+	if end >= 0 && offset >= end {
+		return nil
+	}
+
+	return readLogEntries(store, record, offset, end, func(entry *entities.LogEntry, data []byte) error {
+		switch entry.Stream {
+		case entities.LogStreamStdout:
+			return viewer.WriteOutput(entities.MessageCommandStdout, data)
+		case entities.LogStreamStderr:
+			return viewer.WriteOutput(entities.MessageCommandStderr, data)
+		default:
+			return nil
+		}
+	})
+}
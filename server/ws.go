@@ -6,14 +6,12 @@ import (
 	"io"
 
 	// "os/exec"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/go-zoox/command"
-	"github.com/go-zoox/command/errors"
 	"github.com/go-zoox/commands-as-a-service/entities"
-	"github.com/go-zoox/datetime"
-	"github.com/go-zoox/fs"
 	"github.com/go-zoox/logger"
 	"github.com/go-zoox/websocket"
 	"github.com/go-zoox/websocket/conn"
@@ -22,38 +20,124 @@ import (
 // WSClientWriter is the writer for websocket client
 type WSClientWriter struct {
 	io.Writer
-	Conn websocket.Conn
-	Flag byte
+	Conn   websocket.Conn
+	Flag   byte
+	Stream string
 }
 
 func (w WSClientWriter) Write(p []byte) (n int, err error) {
-	if err := w.Conn.WriteTextMessage(append([]byte{w.Flag}, p...)); err != nil {
+	if err := w.Conn.WriteTextMessage(entities.EncodeFrame(w.Flag, w.Stream, p)); err != nil {
 		return 0, err
 	}
 
 	return len(p), nil
 }
 
+func writeExit(conn websocket.Conn, stream string, exit *entities.Exit) error {
+	message, err := json.Marshal(exit)
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteTextMessage(entities.EncodeFrame(entities.MessageCommandExitCode, stream, message))
+}
+
+func writeStderr(conn websocket.Conn, stream string, message string) error {
+	return conn.WriteTextMessage(entities.EncodeFrame(entities.MessageCommandStderr, stream, []byte(message)))
+}
+
 type ConnData struct {
-	Cmd                        command.Command
 	AuthClient                 *entities.AuthRequest
-	CommandN                   *entities.Command
 	IsAuthenticated            bool
-	Stopped                    bool
-	IsKilledByClose            bool
 	AuthenticationTimeoutTimer *time.Timer
 	HeartbeatTimeoutTimer      *time.Timer
+	// ClientID is the authenticated client id, empty if anonymous
+	ClientID string
+	// Identity is the authenticated client, which has the claims of jwt
+	Identity *Identity
+	// IsCertAuthenticated means the client is authenticated by certificate, the auth request is not verified
+	IsCertAuthenticated bool
+	// IsQuotaConnected means the connection is counted in the quota of client
+	IsQuotaConnected bool
+	//
+	jobsMu sync.Mutex
+	jobs   map[string]*Job
+}
+
+// AddJob adds the job of the stream, returns false if the stream is in use.
+func (d *ConnData) AddJob(job *Job) bool {
+	d.jobsMu.Lock()
+	defer d.jobsMu.Unlock()
+
+	if d.jobs == nil {
+		d.jobs = map[string]*Job{}
+	}
+
+	if _, ok := d.jobs[job.Stream]; ok {
+		return false
+	}
+
+	d.jobs[job.Stream] = job
+	return true
+}
+
+// GetJob returns the job of the stream, or nil if not found.
+func (d *ConnData) GetJob(stream string) *Job {
+	d.jobsMu.Lock()
+	defer d.jobsMu.Unlock()
+
+	return d.jobs[stream]
 }
 
-func createWsService(cfg *Config) func(server websocket.Server) {
+// RemoveJob removes the job from its stream.
+func (d *ConnData) RemoveJob(job *Job) {
+	d.jobsMu.Lock()
+	defer d.jobsMu.Unlock()
+
+	if d.jobs[job.Stream] == job {
+		delete(d.jobs, job.Stream)
+	}
+}
+
+// Jobs returns all the jobs of the connection.
+func (d *ConnData) Jobs() []*Job {
+	d.jobsMu.Lock()
+	defer d.jobsMu.Unlock()
+
+	jobs := make([]*Job, 0, len(d.jobs))
+	for _, job := range d.jobs {
+		jobs = append(jobs, job)
+	}
+
+	return jobs
+}
+
+func createWsService(cfg *Config, jobs *JobManager, conns *ConnManager) func(server websocket.Server) {
 	heartbeatTimeout := 30 * time.Second
 	authenticator := createAuthenticator(cfg)
 
 	return func(server websocket.Server) {
 		server.OnConnect(func(conn conn.Conn) error {
 			data := &ConnData{}
-			if cfg.ClientID == "" && cfg.ClientSecret == "" && cfg.AuthService == "" {
+			if identity, ok := conn.Context().Value(identityContextKey{}).(*Identity); ok {
+				// authenticated by client certificate
+				data.IsAuthenticated = true
+				data.IsCertAuthenticated = true
+				data.Identity = identity
+				data.ClientID = identity.ClientID
+			} else if !cfg.IsAuthRequired() {
 				data.IsAuthenticated = true
+				data.Identity = &Identity{}
+			}
+
+			if data.IsAuthenticated {
+				if err := jobs.Quota().Connect(data.ClientID); err != nil {
+					logger.Infof("[ws][id: %s] rejected: %s", conn.ID(), err)
+					conn.WriteTextMessage(entities.EncodeFrame(entities.MessageAuthResponseFailure, "", []byte(fmt.Sprintf("%s\n", err))))
+					conn.Close()
+					return nil
+				}
+				data.IsQuotaConnected = true
 			}
 
 			data.AuthenticationTimeoutTimer = time.AfterFunc(30*time.Second, func() {
@@ -70,6 +154,7 @@ func createWsService(cfg *Config) func(server websocket.Server) {
 			})
 
 			conn.Set("state", data)
+			conns.Add(conn)
 
 			logger.Debugf("[ws][id: %s] connect", conn.ID())
 			return nil
@@ -77,215 +162,253 @@ func createWsService(cfg *Config) func(server websocket.Server) {
 
 		server.OnClose(func(conn conn.Conn, code int, message string) error {
 			logger.Debugf("[ws][id: %s] Close (code: %d, message: %s)", conn.ID(), code, message)
+			conns.Remove(conn)
 
 			data, ok := conn.Get("state").(*ConnData)
 			if !ok {
 				return fmt.Errorf("failed to get state")
 			}
 
-			if data.Cmd != nil && !data.Stopped {
-				data.IsKilledByClose = true
-				if data.Cmd != nil {
-					data.Cmd.Cancel()
-				}
+			if data.IsQuotaConnected {
+				jobs.Quota().Disconnect(data.ClientID)
+			}
+
+			for _, job := range data.Jobs() {
+				job.KillByClose()
 			}
 
 			return nil
 		})
 
 		server.OnTextMessage(func(conn websocket.Conn, msg []byte) error {
-			go func(conn websocket.Conn, msg []byte) (err error) {
+			flag, stream, payload, err := entities.DecodeFrame(msg)
+			if err != nil {
+				logger.Errorf("[ws][id: %s] failed to decode message: %s", conn.ID(), err)
+				return nil
+			}
+
+			data, ok := conn.Get("state").(*ConnData)
+			if !ok {
+				return fmt.Errorf("failed to get state")
+			}
+
+			// stdin must keep its order and the job must be added before its stdin,
+			// so they are handled in the read loop
+			var job *Job
+			switch flag {
+			case entities.MessageCommandStdin, entities.MessageCommandStdinEOF, entities.MessageTerminalInput:
+				if !data.IsAuthenticated {
+					logger.Errorf("[ws][id: %s] not authenticated, ignore stdin", conn.ID())
+					return nil
+				}
+
+				job = data.GetJob(stream)
+				if job == nil {
+					logger.Debugf("[ws][id: %s] stream(%s) not found, ignore stdin", conn.ID(), stream)
+					return nil
+				}
+
+				if flag == entities.MessageCommandStdinEOF {
+					logger.Debugf("[ws][id: %s] stream(%s) receive stdin eof", conn.ID(), stream)
+					job.CloseStdin()
+					return nil
+				}
+
+				if err := job.WriteStdin(payload); err != nil {
+					logger.Errorf("[ws][id: %s] stream(%s) failed to write stdin: %s", conn.ID(), stream, err)
+					writeStderr(conn, stream, fmt.Sprintf("%s\n", err))
+				}
+				return nil
+			case entities.MessageCommand:
+				if data.IsAuthenticated {
+					if !isValidStream(stream) {
+						writeStderr(conn, stream, "invalid stream\n")
+						writeExit(conn, stream, &entities.Exit{Code: 1, Reason: entities.ExitReasonInvalidRequest, Message: "invalid stream"})
+						return nil
+					}
+
+					job = NewJob(stream)
+					if !data.AddJob(job) {
+						writeStderr(conn, stream, "stream is in use\n")
+						writeExit(conn, stream, &entities.Exit{Code: 1, Reason: entities.ExitReasonInvalidRequest, Message: "stream is in use"})
+						return nil
+					}
+				}
+			}
+
+			go func(conn websocket.Conn, job *Job) (err error) {
 				defer func() {
 					if r := recover(); r != nil {
 						logger.Errorf("[ws][id: %s] receive text message panic => %v", conn.ID(), r)
-						conn.WriteTextMessage(append([]byte{entities.MessageCommandStderr}, []byte(fmt.Sprintf("internal server error: %v\n", r))...))
-						conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(1)})
+						writeStderr(conn, stream, fmt.Sprintf("internal server error: %v\n", r))
+						writeExit(conn, stream, &entities.Exit{Code: 1, Reason: entities.ExitReasonInternalError, Message: fmt.Sprintf("%v", r)})
 						return
 					}
 				}()
 
-				data, ok := conn.Get("state").(*ConnData)
-				if !ok {
-					return fmt.Errorf("failed to get state")
-				}
-
-				switch msg[0] {
+				switch flag {
 				case entities.MessagePing:
 					logger.Debugf("[ws][id: %s] receive ping", conn.ID())
 					data.HeartbeatTimeoutTimer.Reset(heartbeatTimeout)
 					return nil
+				case entities.MessageTerminalResize:
+					job := data.GetJob(stream)
+					if job == nil {
+						logger.Errorf("[ws][id: %s] stream(%s) not found, ignore terminal resize", conn.ID(), stream)
+						return nil
+					}
+
+					size := &entities.TerminalSize{}
+					if err := json.Unmarshal(payload, size); err != nil {
+						logger.Errorf("[ws][id: %s] failed to unmarshal terminal resize: %s", conn.ID(), err)
+						return nil
+					}
+
+					if err := job.ResizeTerminal(size.Rows, size.Cols); err != nil {
+						logger.Errorf("[ws][id: %s] failed to resize terminal: %s", conn.ID(), err)
+					}
+					return nil
+				case entities.MessageCommandSignal:
+					job := data.GetJob(stream)
+					if job == nil {
+						logger.Errorf("[ws][id: %s] stream(%s) not found, ignore signal", conn.ID(), stream)
+						return nil
+					}
+
+					name := string(payload)
+					logger.Infof("[ws][id: %s] stream(%s) receive signal: %s", conn.ID(), stream, name)
+					if err := job.Signal(name); err != nil {
+						logger.Errorf("[ws][id: %s] failed to send signal(%s): %s", conn.ID(), name, err)
+					}
+					return nil
 				case entities.MessageAuthRequest:
 					logger.Infof("[ws][id: %s] auth request", conn.ID())
 					data.AuthClient = &entities.AuthRequest{}
-					if err := json.Unmarshal(msg[1:], data.AuthClient); err != nil {
+					if err := json.Unmarshal(payload, data.AuthClient); err != nil {
 						logger.Errorf("[ws][id: %s] failed to unmarshal auth request: %s", conn.ID(), err)
 						return nil
 					}
 					data.AuthenticationTimeoutTimer.Stop()
-					if err := authenticator(data.AuthClient.ClientID, data.AuthClient.ClientSecret); err != nil {
+					if data.IsCertAuthenticated {
+						logger.Infof("[ws][id: %s] authenticated by certificate: %s", conn.ID(), data.Identity.Subject)
+						conn.WriteTextMessage(entities.EncodeFrame(entities.MessageAuthResponseSuccess, stream, nil))
+						return nil
+					}
+
+					identity, err := authenticator(data.AuthClient)
+					if err != nil {
 						logger.Errorf("[ws][id: %s] failed to authenticate => %v", conn.ID(), err)
 
-						conn.WriteTextMessage(append([]byte{entities.MessageAuthResponseFailure}, []byte(fmt.Sprintf("failed to authenticate: %s\n", err))...))
-						conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(1)})
+						conn.WriteTextMessage(entities.EncodeFrame(entities.MessageAuthResponseFailure, stream, []byte(fmt.Sprintf("failed to authenticate: %s\n", err))))
+						writeExit(conn, stream, &entities.Exit{Code: 1, Reason: entities.ExitReasonUnauthenticated, Message: err.Error()})
 						conn.Close()
 						return nil
 					}
 
+					if !data.IsQuotaConnected {
+						data.ClientID = identity.ClientID
+						data.Identity = identity
+						if err := jobs.Quota().Connect(data.ClientID); err != nil {
+							logger.Infof("[ws][id: %s] rejected: %s", conn.ID(), err)
+
+							conn.WriteTextMessage(entities.EncodeFrame(entities.MessageAuthResponseFailure, stream, []byte(fmt.Sprintf("%s\n", err))))
+							writeExit(conn, stream, &entities.Exit{Code: 1, Reason: entities.ExitReasonQuotaExceeded, Message: err.Error()})
+							conn.Close()
+							return nil
+						}
+						data.IsQuotaConnected = true
+					}
+
 					data.IsAuthenticated = true
 					logger.Infof("[ws][id: %s] authenticated", conn.ID())
-					conn.WriteTextMessage([]byte{entities.MessageAuthResponseSuccess})
+					conn.WriteTextMessage(entities.EncodeFrame(entities.MessageAuthResponseSuccess, stream, nil))
 				case entities.MessageCommand:
-					if !data.IsAuthenticated {
+					// job is only added in read loop when authenticated
+					if job == nil {
 						logger.Errorf("[ws][id: %s] not authenticated", conn.ID())
-						conn.WriteTextMessage(append([]byte{entities.MessageCommandStderr}, []byte("not authenticated\n")...))
-						conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(1)})
+						writeStderr(conn, stream, "not authenticated\n")
+						writeExit(conn, stream, &entities.Exit{Code: 1, Reason: entities.ExitReasonUnauthenticated, Message: "not authenticated"})
 						conn.Close()
 						return nil
 					}
 
+					defer data.RemoveJob(job)
+
 					commandN := &entities.Command{}
-					data.CommandN = commandN
-					tmpScriptFilepath := ""
-					if err := json.Unmarshal(msg[1:], commandN); err != nil {
+					job.CommandN = commandN
+					if err := json.Unmarshal(payload, commandN); err != nil {
 						logger.Errorf("failed to unmarshal command request: %s", err)
 
-						conn.WriteTextMessage(append([]byte{entities.MessageCommandStderr}, []byte("invalid command request\n")...))
-						conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(1)})
+						writeStderr(conn, stream, "invalid command request\n")
+						writeExit(conn, stream, &entities.Exit{Code: 1, Reason: entities.ExitReasonInvalidRequest, Message: err.Error()})
 						return nil
 					}
 
-					id := conn.ID()
-					if commandN.ID != "" {
-						id = commandN.ID
-					}
-					cmdCfg, err := cfg.GetCommandConfig(id, commandN)
-					if err != nil {
-						logger.Errorf("failed to get command config: %s", err)
-						conn.WriteTextMessage(append([]byte{entities.MessageCommandStderr}, []byte("internal server error\n")...))
-						conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(1)})
-						return nil
-					}
-					defer func() {
-						// @TODO clean workdir
-						if cfg.IsAutoCleanWorkDir {
-							if fs.IsExist(cmdCfg.WorkDir) {
-								logger.Infof("[command] clean work dir: %s", cmdCfg.WorkDir)
-								if err := fs.Remove(cmdCfg.WorkDir); err != nil {
-									panic(fmt.Errorf("failed to clean workdir(%s): %s", cmdCfg.WorkDir, err))
-								}
-							}
-						}
-					}()
-
-					env := []string{}
-					environment := map[string]string{
-						// "HOME":    os.Getenv("HOME"),
-						// "USER":    os.Getenv("USER"),
-						// "LOGNAME": os.Getenv("LOGNAME"),
-						// "SHELL":   cfg.Shell,
-						// "TERM":    os.Getenv("TERM"),
-						// "PATH":    os.Getenv("PATH"),
-					}
-					if commandN.Environment != nil {
-						for k, v := range commandN.Environment {
-							environment[k] = v
-						}
-					}
-					if cfg.Environment != nil {
-						for k, v := range cfg.Environment {
-							environment[k] = v
-						}
-					}
-					for k, v := range environment {
-						env = append(env, fmt.Sprintf("%s=%s", k, v))
+					job.ClientID = data.ClientID
+					job.Identity = data.Identity
+					job.ID = conn.ID()
+					if stream != "" {
+						job.ID = fmt.Sprintf("%s_%s", conn.ID(), stream)
 					}
 
-					cmd, err := command.New(&command.Config{
-						Command:     commandN.Script,
-						Shell:       cfg.Shell,
-						WorkDir:     cmdCfg.WorkDir,
-						Environment: environment,
-						User:        commandN.User,
-						Engine:      commandN.Engine,
-						Image:       commandN.Image,
-						Memory:      commandN.Memory,
-						CPU:         commandN.CPU,
-						Platform:    commandN.Platform,
-						Network:     commandN.Network,
-						Privileged:  commandN.Privileged,
+					runJob(cfg, jobs, job, &wsViewer{conn: conn, stream: stream}, func(id string) {
+						data.RemoveJob(job)
+						conn.WriteTextMessage(entities.EncodeFrame(entities.MessageCommandDetached, stream, []byte(id)))
 					})
-					if err != nil {
-						panic(fmt.Errorf("failed to create command (1): %s", err))
-					}
-					data.Cmd = cmd
-
-					// timeout
-					var commandTimeoutTimer *time.Timer
-					if cfg.Timeout != 0 {
-						commandTimeoutTimer = time.AfterFunc(time.Duration(cfg.Timeout)*time.Second, func() {
-							if cmd != nil {
-								cmd.Cancel()
-							}
-						})
+				case entities.MessageCommandAttach:
+					if !data.IsAuthenticated {
+						writeStderr(conn, stream, "not authenticated\n")
+						writeExit(conn, stream, &entities.Exit{Code: 1, Reason: entities.ExitReasonUnauthenticated, Message: "not authenticated"})
+						return nil
 					}
 
-					cmd.SetStdout(io.MultiWriter(cmdCfg.Log, &WSClientWriter{Conn: conn, Flag: entities.MessageCommandStdout}))
-					cmd.SetStderr(io.MultiWriter(cmdCfg.Log, &WSClientWriter{Conn: conn, Flag: entities.MessageCommandStderr}))
-
-					logger.Infof("[command] start to run: %s", commandN.Script)
-					cmdCfg.Script.WriteString(commandN.Script)
-					cmdCfg.Env.WriteString(strings.Join(env, "\n"))
-					cmdCfg.StartAt.WriteString(datetime.Now().Format("YYYY-MM-DD HH:mm:ss"))
-					err = cmd.Run()
-					if err != nil {
-						if data.IsKilledByClose {
-							logger.Infof("[command] killed by Close: %s", commandN.Script)
-							return nil
-						}
-
-						cmdCfg.FailedAt.WriteString(datetime.Now().Format("YYYY-MM-DD HH:mm:ss"))
-						cmdCfg.Error.WriteString(err.Error())
-						cmdCfg.Status.WriteString("failure")
-
-						exitCode := -1
-						if errx, ok := err.(*errors.ExitError); ok {
-							exitCode = errx.ExitCode()
-						}
-
-						logger.Errorf("[command] failed to run: %s (err: %v, exit code: %d)", commandN.Script, err, exitCode)
-						conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(exitCode)})
+					attach := &entities.Attach{}
+					if err := json.Unmarshal(payload, attach); err != nil || !isValidJobID(attach.ID) {
+						writeStderr(conn, stream, "invalid attach request\n")
+						writeExit(conn, stream, &entities.Exit{Code: 1, Reason: entities.ExitReasonInvalidRequest, Message: "invalid attach request"})
 						return nil
 					}
 
-					cmdCfg.SucceedAt.WriteString(datetime.Now().Format("YYYY-MM-DD HH:mm:ss"))
-					cmdCfg.Status.WriteString("success")
-					logger.Infof("[command] succeed to run: %s", commandN.Script)
-
-					conn.WriteTextMessage([]byte{entities.MessageCommandExitCode, byte(0)})
-
-					if tmpScriptFilepath != "" && fs.IsExist(tmpScriptFilepath) {
-						if err := fs.Remove(tmpScriptFilepath); err != nil {
-							panic(fmt.Errorf("failed to remove tmp script file: %s", err))
-						}
+					identity := data.Identity
+					if identity == nil {
+						identity = &Identity{ClientID: data.ClientID}
 					}
-
-					if commandTimeoutTimer != nil {
-						commandTimeoutTimer.Stop()
+					if !identity.Allows(ScopeRead) {
+						message := fmt.Sprintf("permission denied: %s scope is required", ScopeRead)
+						writeStderr(conn, stream, message+"\n")
+						writeExit(conn, stream, &entities.Exit{Code: 1, Reason: entities.ExitReasonPermissionDenied, Message: message})
+						return nil
 					}
 
-					if data.HeartbeatTimeoutTimer != nil {
-						data.HeartbeatTimeoutTimer.Stop()
+					logger.Infof("[ws][id: %s] stream(%s) attach to job: %s (offset: %d)", conn.ID(), stream, attach.ID, attach.Offset)
+					if err := attachJob(jobs, identity, attach, &wsViewer{conn: conn, stream: stream}); err != nil {
+						writeStderr(conn, stream, fmt.Sprintf("failed to attach: %s\n", err))
+						writeExit(conn, stream, &entities.Exit{Code: 1, Reason: entities.ExitReasonInvalidRequest, Message: err.Error()})
 					}
-
-					data.Stopped = true
+					return nil
 				default:
-					logger.Errorf("unknown message type: %d", msg[0])
+					logger.Errorf("unknown message type: %d", flag)
 				}
 
 				return nil
-			}(conn, msg)
+			}(conn, job)
 
 			return nil
 		})
 	}
 }
+
+var streamPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]*$`)
+
+// isValidStream checks the stream id, which is used in the metadata path.
+func isValidStream(stream string) bool {
+	return len(stream) <= entities.MaxStreamLength && streamPattern.MatchString(stream)
+}
+
+var attemptDirPattern = regexp.MustCompile(`\.attempt-\d+$`)
+
+// isValidJobID checks the job id, which is used in the metadata path.
+// The id like the workdir of attempts (<id>.attempt-<n>) is invalid, which conflicts with the attempts of other job.
+func isValidJobID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, "/\\") && !attemptDirPattern.MatchString(id)
+}